@@ -0,0 +1,224 @@
+package ccache
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// The number of evicted keys remembered per policy
+	defaultGhostSize = 1024
+	// How much a policy's weight drops when one of its evictions is missed
+	defaultLearningRate = 0.45
+	// The most policies an Adaptive can switch between, one per bit of the
+	// set of policies which agreed with an eviction
+	maxAdaptivePolicies = 64
+)
+
+// Adaptive is an Evaluator which switches between other evaluators (policies)
+// depending on which is currently doing best, in the spirit of LeCaR.
+//
+// Each policy remembers the keys evicted because of it in a ghost history: an
+// eviction is blamed on every policy which would have picked the same victim
+// out of the candidates the cache sampled for it. When a key in a policy's
+// ghost history is set again, evicting it caused a miss, and that policy's
+// weight is lowered, less so the longer ago the eviction was. Candidates are
+// scored by the policy with the highest weight.
+type Adaptive struct {
+	sync.Mutex
+	names        []string
+	policies     []Evaluator
+	observers    []Observer
+	weights      []float64
+	ghosts       []*ghost
+	active       int32
+	learningRate float64
+	discount     float64
+	evictions    uint64
+}
+
+// Creates an adaptive evaluator over the named evaluators (see
+// RegisterEvaluator), remembering up to ghostSize evicted keys per policy
+func NewAdaptive(ghostSize int, names ...string) (*Adaptive, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("ccache: adaptive evaluator needs at least one policy")
+	}
+	if len(names) > maxAdaptivePolicies {
+		return nil, fmt.Errorf("ccache: adaptive evaluator takes at most %d policies", maxAdaptivePolicies)
+	}
+	if ghostSize < 1 {
+		return nil, fmt.Errorf("ccache: invalid ghost size %d", ghostSize)
+	}
+	a := &Adaptive{
+		names:        names,
+		learningRate: defaultLearningRate,
+		// an eviction is worth about 0.005 of its weight by the time it
+		// leaves the ghost history
+		discount: math.Pow(0.005, 1/float64(ghostSize)),
+	}
+	for _, name := range names {
+		factory, ok := lookupEvaluator(name)
+		if !ok {
+			return nil, fmt.Errorf("ccache: unknown eval algorithm %q", name)
+		}
+		policy := factory()
+		observer, _ := policy.(Observer)
+		a.policies = append(a.policies, policy)
+		a.observers = append(a.observers, observer)
+		a.weights = append(a.weights, 1/float64(len(names)))
+		a.ghosts = append(a.ghosts, newGhost(ghostSize))
+	}
+	return a, nil
+}
+
+func init() {
+	RegisterEvaluator("adaptive", newDefaultAdaptive)
+}
+
+func newDefaultAdaptive() Evaluator {
+	a, _ := NewAdaptive(defaultGhostSize, "lfu", "lru", "hyperbolic", "h1", "h2")
+	return a
+}
+
+// The name of the policy currently scoring candidates
+func (a *Adaptive) Active() string {
+	a.Lock()
+	defer a.Unlock()
+	return a.names[a.active]
+}
+
+// The current weight of each policy. Weights add up to 1.
+func (a *Adaptive) Weights() map[string]float64 {
+	a.Lock()
+	defer a.Unlock()
+	weights := make(map[string]float64, len(a.names))
+	for i, name := range a.names {
+		weights[name] = a.weights[i]
+	}
+	return weights
+}
+
+func (a *Adaptive) Eval(item *Item) float64 {
+	return a.policies[atomic.LoadInt32(&a.active)].Eval(item)
+}
+
+func (a *Adaptive) OnGet(item *Item) {
+	for _, observer := range a.observers {
+		if observer != nil {
+			observer.OnGet(item)
+		}
+	}
+}
+
+func (a *Adaptive) OnSet(item *Item) {
+	for _, observer := range a.observers {
+		if observer != nil {
+			observer.OnSet(item)
+		}
+	}
+	a.Lock()
+	defer a.Unlock()
+	missed := false
+	for i, ghost := range a.ghosts {
+		if evicted, ok := ghost.remove(item.id()); ok {
+			regret := math.Pow(a.discount, float64(a.evictions-evicted))
+			a.weights[i] *= math.Exp(-a.learningRate * regret)
+			missed = true
+		}
+	}
+	if missed {
+		a.rebalance()
+	}
+}
+
+func (a *Adaptive) OnEvict(item *Item) {
+	for _, observer := range a.observers {
+		if observer != nil {
+			observer.OnEvict(item)
+		}
+	}
+}
+
+// Blames the eviction of victim on the policies which would have picked it
+// out of the candidates too
+func (a *Adaptive) round(victim *Item, candidates []*Item) {
+	agreed := uint64(0)
+	for i, policy := range a.policies {
+		score, picked := policy.Eval(victim), true
+		for _, candidate := range candidates {
+			if candidate != victim && policy.Eval(candidate) < score {
+				picked = false
+				break
+			}
+		}
+		if picked {
+			agreed |= 1 << i
+		}
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.evictions++
+	for i := range a.policies {
+		if agreed&(1<<i) != 0 {
+			a.ghosts[i].add(victim.id(), a.evictions)
+		}
+	}
+}
+
+// Normalizes the weights and activates the heaviest policy
+func (a *Adaptive) rebalance() {
+	total := 0.0
+	for _, w := range a.weights {
+		total += w
+	}
+	for i := range a.weights {
+		a.weights[i] /= total
+	}
+	active := int(a.active)
+	for i, w := range a.weights {
+		if w > a.weights[active] {
+			active = i
+		}
+	}
+	atomic.StoreInt32(&a.active, int32(active))
+}
+
+// A bounded history of evicted keys, forgetting the oldest first. Keys are
+// those of Item.id, so the typed keys of a TypedCache work too.
+type ghost struct {
+	keys  map[interface{}]uint64
+	order []ghostEntry
+	next  int
+}
+
+type ghostEntry struct {
+	key     interface{}
+	evicted uint64
+}
+
+func newGhost(size int) *ghost {
+	return &ghost{
+		keys:  make(map[interface{}]uint64, size),
+		order: make([]ghostEntry, size),
+	}
+}
+
+func (g *ghost) add(key interface{}, evicted uint64) {
+	oldest := g.order[g.next]
+	if e, ok := g.keys[oldest.key]; ok && e == oldest.evicted {
+		delete(g.keys, oldest.key)
+	}
+	g.order[g.next] = ghostEntry{key, evicted}
+	g.keys[key] = evicted
+	g.next = (g.next + 1) % len(g.order)
+}
+
+func (g *ghost) remove(key interface{}) (uint64, bool) {
+	evicted, ok := g.keys[key]
+	if ok {
+		delete(g.keys, key)
+	}
+	return evicted, ok
+}
@@ -0,0 +1,102 @@
+package ccache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type AdaptiveTests struct{}
+
+func Test_Adaptive(t *testing.T) {
+	Expectify(new(AdaptiveTests), t)
+}
+
+func (_ AdaptiveTests) RejectsInvalidSettings() {
+	_, err := NewAdaptive(10)
+	Expect(err.Error()).To.Equal("ccache: adaptive evaluator needs at least one policy")
+	_, err = NewAdaptive(10, "lfu", "nope")
+	Expect(err.Error()).To.Equal(`ccache: unknown eval algorithm "nope"`)
+	_, err = NewAdaptive(0, "lfu")
+	Expect(err.Error()).To.Equal("ccache: invalid ghost size 0")
+}
+
+func (_ AdaptiveTests) StartsWithTheFirstPolicy() {
+	a, _ := NewAdaptive(10, "lfu", "lru")
+	Expect(a.Active()).To.Equal("lfu")
+	Expect(a.Weights()).To.Equal(map[string]float64{"lfu": 0.5, "lru": 0.5})
+	frequent := adaptiveItem("frequent", 10, time.Hour)
+	Expect(a.Eval(frequent)).To.Equal(10.0)
+}
+
+func (_ AdaptiveTests) SwitchesAwayFromAPolicyWhoseEvictionsAreMissed() {
+	a, _ := NewAdaptive(10, "lfu", "lru")
+	// lfu picks rare, lru picks old
+	rare := adaptiveItem("rare", 1, 0)
+	old := adaptiveItem("old", 10, time.Hour)
+	a.round(rare, []*Item{rare, old})
+	Expect(a.Active()).To.Equal("lfu")
+
+	a.OnSet(adaptiveItem("rare", 0, 0))
+	Expect(a.Active()).To.Equal("lru")
+	weights := a.Weights()
+	Expect(weights["lru"] > weights["lfu"]).To.Equal(true)
+	Expect(weights["lru"] + weights["lfu"]).To.Equal(1.0)
+	Expect(a.Eval(old)).To.Equal(float64(old.accessed))
+}
+
+func (_ AdaptiveTests) BlamesEvictionsOnEveryPolicyWhichAgreed() {
+	a, _ := NewAdaptive(10, "lfu", "lru")
+	stale := adaptiveItem("stale", 1, time.Hour)
+	a.round(stale, []*Item{adaptiveItem("hot", 10, 0), stale})
+	a.OnSet(stale)
+	Expect(a.Weights()).To.Equal(map[string]float64{"lfu": 0.5, "lru": 0.5})
+	Expect(a.Active()).To.Equal("lfu")
+}
+
+func (_ AdaptiveTests) OnlyLearnsFromEvictionRounds() {
+	a, _ := NewAdaptive(10, "lfu", "lru")
+	rare := adaptiveItem("rare", 1, 0)
+	Expect(testing.AllocsPerRun(10, func() { a.Eval(rare) })).To.Equal(0.0)
+	// scoring and evicting outside of a round, like the sweeper, blames no one
+	a.OnEvict(rare)
+	a.OnSet(rare)
+	Expect(a.Weights()).To.Equal(map[string]float64{"lfu": 0.5, "lru": 0.5})
+}
+
+func (_ AdaptiveTests) ForgetsOldEvictions() {
+	g := newGhost(2)
+	g.add("a", 1)
+	g.add("b", 2)
+	g.add("c", 3)
+	_, ok := g.remove("a")
+	Expect(ok).To.Equal(false)
+	evicted, ok := g.remove("c")
+	Expect(ok).To.Equal(true)
+	Expect(evicted).To.Equal(uint64(3))
+}
+
+func (_ AdaptiveTests) CanBePickedByName() {
+	cache := New(Configure().EvalAlgorithm("adaptive").MaxSize(20).ItemsToPrune(1))
+	for i := 0; i < 200; i++ {
+		key := strconv.Itoa(i % 40)
+		if cache.Get(key) == nil {
+			cache.Set(key, i, time.Minute)
+		}
+	}
+	Expect(cache.size).To.Equal(int64(20))
+	total := 0.0
+	for _, w := range cache.eval.(*Adaptive).Weights() {
+		total += w
+	}
+	Expect(total > 0.999 && total < 1.001).To.Equal(true)
+}
+
+func adaptiveItem(key string, accCount int64, age time.Duration) *Item {
+	item := newItem(key, key, getDefaultReqInfo(key), time.Now().Add(time.Minute).UnixNano())
+	item.accCount = accCount
+	item.accessed = monotonicNow() - int64(age)
+	return item
+}
@@ -0,0 +1,70 @@
+package ccache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// aging halves the items' access frequencies every halfLife, so that keys
+// which used to be hot don't keep out the currently hot ones forever. Rather
+// than walking every item each period, items keep their frequency along with
+// the period it was last updated in, packed in a single uint64, and the
+// halvings they missed are applied when it is read or updated.
+type aging struct {
+	halfLife int64
+}
+
+const (
+	// The frequency is kept in the lower half of Item.freq, its period in
+	// the upper half
+	frequencyBits = 32
+	frequencyMask = 1<<frequencyBits - 1
+)
+
+func newAging(halfLife time.Duration) *aging {
+	if halfLife <= 0 {
+		return nil
+	}
+	return &aging{halfLife: int64(halfLife)}
+}
+
+// The current half-life period
+func (a *aging) period() uint64 {
+	return uint64(monotonicNow()/a.halfLife) & frequencyMask
+}
+
+// The packed frequency, halved once for every period since it was updated
+func (a *aging) decay(freq uint64, period uint64) uint64 {
+	halvings := (period - freq>>frequencyBits) & frequencyMask
+	if halvings >= frequencyBits {
+		return 0
+	}
+	return (freq & frequencyMask) >> halvings
+}
+
+func (a *aging) frequency(freq *uint64) int64 {
+	return int64(a.decay(atomic.LoadUint64(freq), a.period()))
+}
+
+// Records an access in freq
+func (a *aging) touch(freq *uint64) {
+	period := a.period()
+	for {
+		old := atomic.LoadUint64(freq)
+		count := a.decay(old, period)
+		if count < frequencyMask {
+			count++
+		}
+		if atomic.CompareAndSwapUint64(freq, old, period<<frequencyBits|count) {
+			return
+		}
+	}
+}
+
+// Sets freq to count as of now, used for restored items
+func (a *aging) reset(freq *uint64, count int64) {
+	if count > frequencyMask {
+		count = frequencyMask
+	}
+	atomic.StoreUint64(freq, a.period()<<frequencyBits|uint64(count))
+}
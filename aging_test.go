@@ -0,0 +1,108 @@
+package ccache
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type AgingTests struct{}
+
+func Test_Aging(t *testing.T) {
+	Expectify(new(AgingTests), t)
+}
+
+func (_ AgingTests) IsDisabledByDefault() {
+	cache := New(Configure())
+	cache.Set("spice", "flow", time.Minute)
+	for i := 0; i < 3; i++ {
+		cache.Get("spice")
+	}
+	item := cache.Get("spice")
+	Expect(item.aging).To.Equal((*aging)(nil))
+	Expect(item.Frequency()).To.Equal(int64(4))
+}
+
+func (_ AgingTests) CountsAccessesWithinAPeriod() {
+	cache := New(Configure().FrequencyHalfLife(time.Hour))
+	cache.Set("spice", "flow", time.Minute)
+	for i := 0; i < 3; i++ {
+		cache.Get("spice")
+	}
+	item := cache.Get("spice")
+	Expect(item.Frequency()).To.Equal(int64(4))
+	Expect(item.AccessCount()).To.Equal(int64(4))
+}
+
+func (_ AgingTests) HalvesFrequenciesEveryPeriod() {
+	a := newAging(time.Hour)
+	period := a.period()
+	Expect(a.decay((period)<<frequencyBits|40, period)).To.Equal(uint64(40))
+	Expect(a.decay((period-1)<<frequencyBits|40, period)).To.Equal(uint64(20))
+	Expect(a.decay((period-3)<<frequencyBits|40, period)).To.Equal(uint64(5))
+	Expect(a.decay((period-40)<<frequencyBits|40, period)).To.Equal(uint64(0))
+}
+
+func (_ AgingTests) DecaysBeforeCountingAnAccess() {
+	cache := New(Configure().FrequencyHalfLife(time.Hour))
+	item, _ := cache.set("spice", "flow", getDefaultReqInfo("flow"), time.Minute)
+	item.freq = (cache.aging.period()-2)<<frequencyBits | 16
+	cache.Get("spice")
+	Expect(item.Frequency()).To.Equal(int64(5))
+}
+
+func (_ AgingTests) AgesTheFrequencyBasedEvaluators() {
+	for _, name := range []string{"lfu", "hyperbolic", "h1", "h2"} {
+		cache := New(Configure().FrequencyHalfLife(time.Hour).EvalAlgorithm(name))
+		hot, _ := cache.set("hot", 1, getDefaultReqInfo(1), time.Minute)
+		hot.freq = (cache.aging.period()-5)<<frequencyBits | 64
+		hot.accCount = 64
+		warm, _ := cache.set("warm", 1, getDefaultReqInfo(1), time.Minute)
+		for i := 0; i < 4; i++ {
+			cache.Get("warm")
+		}
+		warm.created = hot.created
+		Expect(cache.eval.Eval(hot) < cache.eval.Eval(warm)).To.Equal(true)
+	}
+}
+
+func (_ AgingTests) EvictsFormerlyHotItems() {
+	// the new item and the formerly hot one both score 0 and are evicted
+	cache := New(Configure().MaxSize(10).ItemsToPrune(2).Buckets(256).Candidates(200).FrequencyHalfLife(time.Hour))
+	for i := 0; i < 10; i++ {
+		item, _ := cache.set(strconv.Itoa(i), i, getDefaultReqInfo(i), time.Minute)
+		cache.Get(strconv.Itoa(i))
+		cache.Get(strconv.Itoa(i))
+		if i == 0 {
+			item.freq = (cache.aging.period()-10)<<frequencyBits | 1000
+		}
+	}
+	cache.Set("spice", "flow", time.Minute)
+	Expect(cache.Get("0")).To.Equal(nil)
+	for i := 1; i < 10; i++ {
+		Expect(cache.Get(strconv.Itoa(i)).Value()).To.Equal(i)
+	}
+}
+
+func (_ AgingTests) AgesLayeredItems() {
+	layered := Layered(Configure().FrequencyHalfLife(time.Hour))
+	layered.Set("spice", "flow", "must", time.Minute)
+	Expect(layered.Get("spice", "flow").aging).To.Equal(layered.aging)
+}
+
+func (_ AgingTests) RestoresFrequenciesFromSnapshots() {
+	snapshot := &bytes.Buffer{}
+	source := New(Configure())
+	source.Set("spice", "flow", time.Minute)
+	for i := 0; i < 6; i++ {
+		source.Get("spice")
+	}
+	Expect(source.Snapshot(snapshot)).To.Equal(nil)
+
+	cache := New(Configure().FrequencyHalfLife(time.Hour))
+	Expect(cache.RestoreFrom(snapshot)).To.Equal(nil)
+	Expect(cache.Get("spice").Frequency()).To.Equal(int64(7))
+}
@@ -0,0 +1,137 @@
+package ccache
+
+// A Cache's buckets index the objects of GetPage and SetPage by backend: the
+// uris of each backend's objects in the bucket. The index is kept along with
+// the bucket's lookup, under the bucket's lock, so every set, delete,
+// eviction and Reshard updates it. The buckets of a LayeredCache have none.
+type backendIndex map[uint64]map[uint64]struct{}
+
+func (x backendIndex) add(key string) {
+	if x == nil {
+		return
+	}
+	backend, uri, ok := splitKey(key)
+	if !ok {
+		return
+	}
+	uris := x[backend]
+	if uris == nil {
+		uris = make(map[uint64]struct{})
+		x[backend] = uris
+	}
+	uris[uri] = struct{}{}
+}
+
+func (x backendIndex) remove(key string) {
+	backend, uri, ok := splitKey(key)
+	if !ok {
+		return
+	}
+	if uris := x[backend]; uris != nil {
+		delete(uris, uri)
+		if len(uris) == 0 {
+			delete(x, backend)
+		}
+	}
+}
+
+// Removes the backend's items from the bucket and returns them. Returns
+// nothing once the bucket moved.
+func (b *bucket) deleteBackend(backend uint64) []*Item {
+	b.Lock()
+	defer b.Unlock()
+	if b.moved == 1 {
+		return nil
+	}
+	uris := b.backends[backend]
+	items := make([]*Item, 0, len(uris))
+	var buf [maxPageKeySize]byte
+	for uri := range uris {
+		if item, ok := b.deleteInner(string(putKey(&buf, backend, uri))); ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// The uris of the backend's items, appended to uris
+func (b *bucket) backendUris(backend uint64, uris []uint64) []uint64 {
+	b.RLock()
+	defer b.RUnlock()
+	if b.moved == 1 {
+		return uris
+	}
+	for uri := range b.backends[backend] {
+		uris = append(uris, uri)
+	}
+	return uris
+}
+
+// One of the backend's items, and its score, or nil if the bucket has none
+func (b *bucket) backendCandidate(backend uint64, e Evaluator) (*Item, float64) {
+	b.RLock()
+	defer b.RUnlock()
+	if b.moved == 1 {
+		return nil, 0
+	}
+	// map iteration starts at a random uri, whose key is looked up without
+	// allocating it
+	var buf [maxPageKeySize]byte
+	for uri := range b.backends[backend] {
+		item := b.arr[b.lookup[string(putKey(&buf, backend, uri))]]
+		return item, e.Eval(item)
+	}
+	return nil, 0
+}
+
+func (b *bucket) countBackend(backend uint64) int {
+	b.RLock()
+	defer b.RUnlock()
+	if b.moved == 1 {
+		return 0
+	}
+	return len(b.backends[backend])
+}
+
+// Deletes every object of the backend set by SetPage (or its variants), as
+// Delete would, and returns how many were deleted. Objects of the backend
+// set while it runs may be left in the cache. Waits for a Reshard in
+// progress to complete.
+func (c *Cache) DeleteBackend(backend uint64) int {
+	c.reshardLock.Lock()
+	defer c.reshardLock.Unlock()
+	deleted := 0
+	for _, bucket := range c.table().buckets {
+		for _, item := range bucket.deleteBackend(backend) {
+			bucket.stats.delete()
+			c.afterDelete(item, RemovedDeleted, 0)
+			deleted++
+		}
+	}
+	c.backends.drop(backend)
+	return deleted
+}
+
+// The number of cached objects of the backend, expired ones included. Like
+// DeleteBackend, waits for a Reshard in progress to complete.
+func (c *Cache) CountBackend(backend uint64) int {
+	c.reshardLock.Lock()
+	defer c.reshardLock.Unlock()
+	count := 0
+	for _, bucket := range c.table().buckets {
+		count += bucket.countBackend(backend)
+	}
+	return count
+}
+
+// The uris of the cached objects of the backend, expired ones included, in
+// no particular order
+func (c *Cache) KeysForBackend(backend uint64) []uint64 {
+	c.reshardLock.Lock()
+	defer c.reshardLock.Unlock()
+	var uris []uint64
+	for _, bucket := range c.table().buckets {
+		uris = bucket.backendUris(backend, uris)
+	}
+	return uris
+}
@@ -0,0 +1,137 @@
+package ccache
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type BackendTests struct{}
+
+func Test_Backend(t *testing.T) {
+	Expectify(new(BackendTests), t)
+}
+
+func (_ BackendTests) DeletesEveryObjectOfABackend() {
+	deleted := 0
+	cache := New(Configure().OnDelete(func(item *Item) { deleted++ }))
+	cache.SetPage(page(1, 1, 2, 3), time.Minute)
+	cache.SetPage(page(1, 4, 5), time.Minute)
+	cache.SetPage(page(2, 1, 2), time.Minute)
+	cache.Set("spice", "flow", time.Minute)
+
+	Expect(cache.DeleteBackend(1)).To.Equal(5)
+	Expect(deleted).To.Equal(5)
+	Expect(cache.CountBackend(1)).To.Equal(0)
+	Expect(cache.Get(buildKey(1, 4))).To.Equal(nil)
+	Expect(cache.Get(buildKey(2, 1)).Value()).To.Equal(1)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	checkSize(cache, 3)
+	Expect(cache.Stats().Deletes).To.Equal(uint64(5))
+	Expect(cache.DeleteBackend(1)).To.Equal(0)
+}
+
+func (_ BackendTests) ListsAndCountsABackend() {
+	cache := New(Configure())
+	cache.SetPage(page(1, 9, 3, 7), time.Minute)
+	cache.SetPage(page(2, 1), time.Minute)
+	// setting an object again doesn't count it twice
+	cache.SetPage(page(1, 3), time.Minute)
+
+	Expect(cache.CountBackend(1)).To.Equal(3)
+	Expect(cache.CountBackend(2)).To.Equal(1)
+	Expect(cache.CountBackend(3)).To.Equal(0)
+	Expect(sortedUris(cache.KeysForBackend(1))).To.Equal([]uint64{3, 7, 9})
+	Expect(len(cache.KeysForBackend(3))).To.Equal(0)
+}
+
+func (_ BackendTests) FollowsDeletesAndEvictions() {
+	cache := New(Configure().MaxSize(10).ItemsToPrune(1))
+	cache.SetPage(page(1, 1, 2, 3, 4), time.Minute)
+	cache.Delete(buildKey(1, 1))
+	victim := cache.Get(buildKey(1, 2))
+	cache.evictItem(cache.bucketIndex(victim.key), victim, 0)
+	Expect(sortedUris(cache.KeysForBackend(1))).To.Equal([]uint64{3, 4})
+
+	cache.SetPage(page(2, 1, 2), -time.Minute)
+	Expect(cache.sweepPass(100)).To.Equal(2)
+	Expect(cache.CountBackend(2)).To.Equal(0)
+
+	for i := 0; i < 20; i++ {
+		cache.SetPage(page(3, uint64(i)), time.Minute)
+	}
+	Expect(cache.CountBackend(1) + cache.CountBackend(3)).To.Equal(10)
+
+	cache.Clear()
+	Expect(cache.CountBackend(3)).To.Equal(0)
+}
+
+func (_ BackendTests) FollowsRestoresAndReshards() {
+	cache := New(Configure().Buckets(4))
+	cache.SetPage(page(1, 1, 2, 3, 4, 5, 6, 7, 8), time.Minute)
+	Expect(cache.Reshard(32)).To.Equal(nil)
+	Expect(cache.CountBackend(1)).To.Equal(8)
+	Expect(cache.DeleteBackend(1)).To.Equal(8)
+
+	cache.SetPage(page(2, 1, 2), time.Minute)
+	restored := snapshotRoundTrip(cache)
+	Expect(sortedUris(restored.KeysForBackend(2))).To.Equal([]uint64{1, 2})
+}
+
+func (_ BackendTests) DeletesWhileInUse() {
+	cache := New(Configure().Buckets(4).MaxSize(1000))
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				backend := uint64(i % 3)
+				switch (i + g) % 5 {
+				case 0:
+					cache.DeleteBackend(backend)
+				case 1:
+					cache.Reshard(uint32(2 << (i % 4)))
+				default:
+					cache.SetPage(page(backend, uint64(i), uint64(i+1)), time.Minute)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	count, items := 0, 0
+	for backend := uint64(0); backend < 3; backend++ {
+		for _, uri := range cache.KeysForBackend(backend) {
+			Expect(cache.Get(buildKey(backend, uri))).Not.To.Equal(nil)
+		}
+		count += cache.CountBackend(backend)
+	}
+	for _, bucket := range cache.table().buckets {
+		items += bucket.getNum()
+	}
+	Expect(count).To.Equal(items)
+}
+
+func (_ BackendTests) LayeredCachesDontIndex() {
+	cache := Layered(Configure())
+	cache.Set("spice", buildKey(1, 1), "flow", time.Minute)
+	Expect(cache.bucket("spice").getSecondaryBucket("spice").backends).To.Equal(backendIndex(nil))
+}
+
+func sortedUris(uris []uint64) []uint64 {
+	sort.Slice(uris, func(i, j int) bool { return uris[i] < uris[j] })
+	return uris
+}
+
+func snapshotRoundTrip(cache *Cache) *Cache {
+	var buf bytes.Buffer
+	cache.Snapshot(&buf)
+	restored := New(Configure())
+	restored.RestoreFrom(&buf)
+	return restored
+}
@@ -3,15 +3,25 @@ package ccache
 import (
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type bucket struct {
+	stats counters
 	sync.RWMutex
 	lookup map[string]int
 	arr []*Item
 	init int
 	updateRatio float64
+	aging *aging
+	memory bool
+	// with Track, sets leave the items referenced through TrackingGet in place
+	tracking bool
+	backends backendIndex
+	// set once Reshard moved the items to new buckets, after which the
+	// bucket only serves reads
+	moved int32
 }
 
 func NewArr(initSize int) []*Item {
@@ -33,41 +43,116 @@ func (b *bucket) get(key string) *Item {
 	itemId, ok := b.lookup[key]
 	if ok {
 		item := b.arr[itemId]
-		item.accCount++
-		item.accessTs = time.Now()
+		item.access()
 		return item
 	}
 
 	return nil
 }
 
-func (b *bucket) set(key string, value interface{}, r *ReqInfo, duration time.Duration) (*Item, *Item) {
+// Like get, but doesn't count as an access
+func (b *bucket) peek(key string) *Item {
+	b.RLock()
+	defer b.RUnlock()
+	if itemId, ok := b.lookup[key]; ok {
+		return b.arr[itemId]
+	}
+	return nil
+}
+
+// Like setItem, for a bucket which is never moved
+func (b *bucket) set(key string, value interface{}, r *ReqInfo, duration time.Duration) (*Item, *Item, bool) {
 	expires := time.Now().Add(duration).UnixNano()
 	item := newItem(key, value, r, expires)
+	if b.memory {
+		item.size = entryMemory(key, value)
+	}
+	existing, stored, _ := b.setItem(item)
+	return item, existing, stored
+}
+
+// Stores the item under its key, returning the item it replaced. With
+// tracking, an existing item referenced through TrackingGet is left in place
+// instead, and returned with stored false. Returns false for ok, without
+// storing the item, if the bucket was moved by Reshard.
+func (b *bucket) setItem(item *Item) (*Item, bool, bool) {
 	b.Lock()
 	defer b.Unlock()
+	if b.moved == 1 {
+		return nil, false, false
+	}
+	item.aging = b.aging
 
-	existingId, ok := b.lookup[key]
+	existingId, ok := b.lookup[item.key]
 	if ok {
 		existing := b.arr[existingId]
+		if b.tracking && existing.pinned() {
+			return existing, false, true
+		}
 		b.arr[existingId] = item
 		item.idx = existingId
 		item.MixReqInfo(&existing.reqInfo, b.updateRatio)
-		return item, existing
+		return existing, true, true
 	} else {
 		b.arr = append(b.arr, item)
 		item.idx = len(b.arr) - 1
-		b.lookup[key] = item.idx
-		return item, nil
+		b.lookup[item.key] = item.idx
+		b.backends.add(item.key)
+		return nil, true, true
 	}
 }
 
+// Stores an item rebuilt from a snapshot as is, with its aged frequency,
+// returning the item it replaced. Like setItem, returns false if the bucket
+// was moved.
+func (b *bucket) restore(item *Item, frequency int64) (*Item, bool) {
+	b.Lock()
+	defer b.Unlock()
+	if b.moved == 1 {
+		return nil, false
+	}
+	if b.aging != nil {
+		item.aging = b.aging
+		b.aging.reset(&item.freq, frequency)
+	}
+	if existingId, ok := b.lookup[item.key]; ok {
+		existing := b.arr[existingId]
+		b.arr[existingId] = item
+		item.idx = existingId
+		return existing, true
+	}
+	b.arr = append(b.arr, item)
+	item.idx = len(b.arr) - 1
+	b.lookup[item.key] = item.idx
+	b.backends.add(item.key)
+	return nil, true
+}
+
+// Deletes the key. Returns false if it wasn't found, or if the bucket was
+// moved.
 func (b *bucket) delete(key string) (*Item, bool) {
 	b.Lock()
 	defer b.Unlock()
+	if b.moved == 1 {
+		return nil, false
+	}
 	return b.deleteInner(key)
 }
 
+// Removes the item only if it is still the one stored under its key
+func (b *bucket) deleteItem(item *Item) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.moved == 1 {
+		return false
+	}
+	if itemId, ok := b.lookup[item.key]; !ok || b.arr[itemId] != item {
+		return false
+	}
+	_, ok := b.deleteInner(item.key)
+	return ok
+}
+
 func (b *bucket) deleteInner(key string) (*Item, bool) {
 
 	itemId, ok := b.lookup[key]
@@ -82,30 +167,90 @@ func (b *bucket) deleteInner(key string) (*Item, bool) {
 
 		b.arr = b.arr[:len(b.arr)-1]
 		delete(b.lookup, key)
+		b.backends.remove(key)
 
 		return item, true
 	}
 	return nil, false
 }
 
-func (b *bucket) getNum() int {
+// Whether the item is still the one stored under its key
+func (b *bucket) contains(item *Item) bool {
 	b.RLock()
 	defer b.RUnlock()
+	itemId, ok := b.lookup[item.key]
+	return ok && b.moved == 0 && b.arr[itemId] == item
+}
 
+// The number of items, 0 once the bucket moved
+func (b *bucket) getNum() int {
+	b.RLock()
+	defer b.RUnlock()
+	if b.moved == 1 {
+		return 0
+	}
 	return len(b.arr)
 }
 
-func (b *bucket) getCandidate(e func(i *Item)float64) (*Item, float64) {
+// Looks at up to count items starting at position from and returns the ones
+// which expired before now, along with the number of items looked at
+func (b *bucket) expired(from, count int, now int64) ([]*Item, int) {
+	b.RLock()
+	defer b.RUnlock()
+
+	if from >= len(b.arr) {
+		return nil, 0
+	}
+	if rest := len(b.arr) - from; count > rest {
+		count = rest
+	}
+	var expired []*Item
+	for _, item := range b.arr[from : from+count] {
+		if atomic.LoadInt64(&item.expires) < now {
+			expired = append(expired, item)
+		}
+	}
+	return expired, count
+}
+
+func (b *bucket) getCandidate(e Evaluator) (*Item, float64) {
 	b.RLock()
 	defer b.RUnlock()
 
 	l := len(b.arr)
-	if l == 0 {
+	if l == 0 || b.moved == 1 {
 		return nil, 0
 	}
 	itemId := rand.Intn(l)
 	item := b.arr[itemId]
-	return item, e(item)
+	return item, e.Eval(item)
+}
+
+// Moves every item to its bucket in to, then leaves the bucket read only.
+// Gets which picked the bucket before it moved find the items as they were
+// when they moved.
+func (b *bucket) migrate(to *shards) {
+	b.Lock()
+	defer b.Unlock()
+	for _, item := range b.arr {
+		to.bucket(item.key).add(item)
+	}
+	atomic.StoreInt32(&b.moved, 1)
+}
+
+// Adds an item whose key isn't in the bucket yet
+func (b *bucket) add(item *Item) {
+	b.Lock()
+	defer b.Unlock()
+	b.arr = append(b.arr, item)
+	item.idx = len(b.arr) - 1
+	b.lookup[item.key] = item.idx
+	b.backends.add(item.key)
+}
+
+// Whether Reshard moved the bucket's items to new buckets
+func (b *bucket) isMoved() bool {
+	return atomic.LoadInt32(&b.moved) == 1
 }
 
 func (b *bucket) clear() {
@@ -113,5 +258,21 @@ func (b *bucket) clear() {
 	defer b.Unlock()
 	b.lookup = make(map[string]int)
 	b.arr = NewArr(b.init)
+	if b.backends != nil {
+		b.backends = make(backendIndex)
+	}
 }
 
+
+// Removes every item from the bucket and returns them
+func (b *bucket) deleteAll() []*Item {
+	b.Lock()
+	defer b.Unlock()
+	items := b.arr
+	b.lookup = make(map[string]int)
+	b.arr = NewArr(b.init)
+	if b.backends != nil {
+		b.backends = make(backendIndex)
+	}
+	return items
+}
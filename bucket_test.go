@@ -33,7 +33,7 @@ func (_ *BucketTests) DeleteItemFromBucket() {
 func (_ *BucketTests) SetsANewBucketItem() {
 	bucket := testBucket()
 	val := TestValue("flow")
-	item, existing := bucket.set("spice", val, getDefaultReqInfo(val), time.Minute)
+	item, existing, _ := bucket.set("spice", val, getDefaultReqInfo(val), time.Minute)
 	assertValue(item, "flow")
 	item = bucket.get("spice")
 	assertValue(item, "flow")
@@ -43,12 +43,12 @@ func (_ *BucketTests) SetsANewBucketItem() {
 func (_ *BucketTests) SetsAnExistingItem() {
 	bucket := testBucket()
 	val := TestValue("9001")
-	item, existing := bucket.set("power", val, getDefaultReqInfo(val), time.Minute)
+	item, existing, _ := bucket.set("power", val, getDefaultReqInfo(val), time.Minute)
 	assertValue(existing, "9000")
 	item = bucket.get("power")
 	assertValue(item, "9001")
 	val = TestValue("9002")
-	item, existing = bucket.set("power", val, getDefaultReqInfo(val), time.Minute)
+	item, existing, _ = bucket.set("power", val, getDefaultReqInfo(val), time.Minute)
 	assertValue(existing, "9001")
 }
 
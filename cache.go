@@ -3,30 +3,32 @@ package ccache
 
 import "C"
 import (
-	"hash/fnv"
-	"math/rand"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 )
 
-const EPSILON = 0.0000001
-
 type Cache struct {
 	*Configuration
+	evictor
 	size        int64
-	counter     uint64
-	buckets     []*bucket
-	bucketMask  uint32
+	pages       pageCounters
+	backends    *backends
+	flights     flights
+	shards      unsafe.Pointer // *shards
+	migration   unsafe.Pointer // *migration
+	reshardLock sync.Mutex
+	retired     counters // of the buckets replaced by Reshard
 	deletables  chan *Item
 	promotables chan *Item
-	tables unsafe.Pointer
-	eval        func(i *Item)float64
-}
-
-type samplingTables struct {
-	tableU []float64
-	tableK []int
+	eval        Evaluator
+	observer    Observer
+	sweeper     sweeper
+	filter      *tinyLFU
+	runLock     sync.Mutex // guards stop and donec
+	stop        chan struct{}
+	donec       chan struct{}
 }
 
 // Create a new cache with the specified configuration
@@ -34,13 +36,15 @@ type samplingTables struct {
 func New(config *Configuration) *Cache {
 	c := &Cache{
 		Configuration: config,
-		counter: 0,
-		bucketMask:    uint32(config.buckets) - 1,
-		buckets:       make([]*bucket, config.buckets),
-		eval: config.evalAlgorithm,
+		evictor:       newEvictor(config),
+		eval:          config.newEvaluator(),
+		backends:      newBackends(config),
 	}
-	for i := 0; i < int(config.buckets); i++ {
-		c.buckets[i] = NewBucket(config.initBucketSize, c.updateRatio)
+	c.shards = unsafe.Pointer(newShards(config.buckets, config, c.aging))
+	c.observer, _ = c.eval.(Observer)
+	c.rounds, _ = c.eval.(roundObserver)
+	if config.tinyLFU > 0 {
+		c.filter = newTinyLFU(config.tinyLFU)
 	}
 	c.restart()
 	return c
@@ -51,11 +55,24 @@ func New(config *Configuration) *Cache {
 // is expired and item.TTL() to see how long until the item expires (which
 // will be negative for an already expired item).
 func (c *Cache) Get(key string) *Item {
-	item := c.bucket(key).get(key)
+	return c.get(c.bucket(key), key)
+}
+
+// Get, from the key's bucket. Doesn't retain key, so that GetPage can look
+// keys up without allocating them.
+func (c *Cache) get(bucket *bucket, key string) *Item {
+	if c.filter != nil {
+		c.filter.increment(hashKey64(key))
+	}
+	item := bucket.get(key)
 	if item == nil {
+		bucket.stats.miss()
 		return nil
 	}
-
+	bucket.stats.hit(item)
+	if c.observer != nil {
+		c.observer.OnGet(item)
+	}
 	return item
 }
 
@@ -78,39 +95,118 @@ func (c *Cache) Set(key string, value interface{}, duration time.Duration) {
 }
 
 // Replace the value if it exists, does not set if it doesn't.
-// Returns true if the item existed an was replaced, false otherwise.
+// Returns true if the item existed an was replaced, false otherwise, which
+// includes a tracked item left in place.
 // Replace does not reset item's TTL
 func (c *Cache) Replace(key string,  value interface{}) bool {
 	item := c.bucket(key).get(key)
 	if item == nil {
 		return false
 	}
-	c.Set(key, value, item.TTL())
-	return true
+	atomic.AddUint64(&c.counter, 1)
+	_, replaced := c.set(key, value, getDefaultReqInfo(value), item.TTL())
+	return replaced
 }
 
 // Attempts to get the value from the cache and calles fetch on a miss (missing
 // or stale item). If fetch returns an error, no value is cached and the error
 // is returned back to the caller.
+// Concurrent misses on the same key are coalesced: fetch only runs in one of
+// the callers and the others get its result, or its error.
 func (c *Cache) Fetch(key string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
 	item := c.Get(key)
 	if item != nil && !item.Expired() {
 		return item, nil
 	}
+	return c.fetchMiss(key, duration, fetch)
+}
+
+// Like Fetch, but an item which expired less than grace ago is returned right
+// away while a single background fetch refreshes it. Beyond the grace window,
+// FetchStale blocks like Fetch. When the background fetch fails, the stale
+// item is kept and the error goes to the OnRefreshError callback.
+func (c *Cache) FetchStale(key string, duration, grace time.Duration, fetch func() (interface{}, error)) (*Item, error) {
+	item := c.Get(key)
+	if item == nil || item.TTL() <= -grace {
+		return c.fetchMiss(key, duration, fetch)
+	}
+	if item.Expired() {
+		if _, leader := c.flights.claim(key); leader {
+			go c.refresh(key, duration, fetch)
+		}
+	}
+	return item, nil
+}
+
+func (c *Cache) refresh(key string, duration time.Duration, fetch func() (interface{}, error)) {
+	if _, err := c.fetchFlight(key, duration, fetch); err != nil && c.onRefreshError != nil {
+		c.onRefreshError(key, err)
+	}
+}
+
+func (c *Cache) fetchMiss(key string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
+	fl, leader := c.flights.claim(key)
+	if leader {
+		return c.fetchFlight(key, duration, fetch)
+	}
+	c.waitFlight(key, fl)
+	if fl.err != nil || fl.item != nil {
+		return fl.item, fl.err
+	}
+	// the load was abandoned, do it ourselves
+	return c.load(key, duration, fetch)
+}
+
+// Loads the value and completes the key's flight with the result, even if
+// fetch panics
+func (c *Cache) fetchFlight(key string, duration time.Duration, fetch func() (interface{}, error)) (item *Item, err error) {
+	defer func() {
+		var value interface{}
+		if item != nil {
+			value = item.value
+		}
+		c.flights.complete(key, item, value, err)
+	}()
+	// the previous flight could have landed between our Get and our claim
+	if existing := c.bucket(key).peek(key); existing != nil && !existing.Expired() {
+		return existing, nil
+	}
+	return c.load(key, duration, fetch)
+}
+
+func (c *Cache) load(key string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
 	value, err := fetch()
 	if err != nil {
 		return nil, err
 	}
-	return c.set(key, value, getDefaultReqInfo(value), duration), nil
+	item, _ := c.set(key, value, getDefaultReqInfo(value), duration)
+	return item, nil
+}
+
+// Waits for another caller's load of the key. With CoalescePages, the wait is
+// bounded since page loads rely on the caller to complete them.
+func (c *Cache) waitFlight(key string, fl *flight) {
+	if c.coalescePages == 0 {
+		<-fl.done
+		return
+	}
+	c.flights.wait(key, fl, time.Now().Add(c.coalescePages))
 }
 
 // Remove the item from the cache, return true if the item was present, false otherwise.
 func (c *Cache) Delete(key string) bool {
 	atomic.AddUint64(&c.counter, 1)
-	item, _ := c.bucket(key).delete(key)
+	bucket := c.bucket(key)
+	item, _ := bucket.delete(key)
+	for item == nil && bucket.isMoved() {
+		// resharded in the meantime
+		bucket = c.bucket(key)
+		item, _ = bucket.delete(key)
+	}
 	if item != nil {
+		bucket.stats.delete()
 		//c.deletables <- item
-		c.afterDelete(item)
+		c.afterDelete(item, RemovedDeleted, 0)
 		return true
 	}
 	return false
@@ -118,55 +214,170 @@ func (c *Cache) Delete(key string) bool {
 
 //this isn't thread safe. It's meant to be called from non-concurrent tests
 func (c *Cache) Clear() {
-	for _, bucket := range c.buckets {
-		bucket.clear()
+	for _, bucket := range c.table().buckets {
+		for _, item := range bucket.deleteAll() {
+			c.evicted(item, RemovedCleared, 0)
+		}
 	}
 	atomic.StoreInt64(&c.size, 0)
+	c.backends.clear()
 }
 
-// Stops the background worker. Operations performed on the cache after Stop
-// is called are likely to panic
+// Changes the max size (the max memory, with MaxMemory) of the cache. If the
+// cache holds more than that, it's shrunk in the background, a few items at
+// a time. Candidates, ItemsToPrune and CountPerSampling can be changed
+// likewise with SetCandidates, SetItemsToPrune and SetCountPerSampling.
+func (c *Cache) SetMaxSize(max int64) {
+	c.resize(max, &c.size, c)
+}
+
+// Stops the background sweeper and waits for it to exit. The cache remains
+// usable, but expired items are no longer removed proactively
 func (c *Cache) Stop() {
-	//close(c.promotables)
-	//<-c.donec
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	if c.donec == nil {
+		return
+	}
+	close(c.stop)
+	<-c.donec
+	c.donec = nil
 }
 
 func (c *Cache) restart() {
-	//c.deletables = make(chan *Item, c.deleteBuffer)
-	//c.promotables = make(chan *Item, c.promoteBuffer)
-	//c.donec = make(chan struct{})
-	//go c.worker()
+	if c.sweepInterval == 0 {
+		return
+	}
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	if c.donec != nil {
+		// already running
+		return
+	}
+	c.stop = make(chan struct{})
+	c.donec = make(chan struct{})
+	go c.sweep(c.stop, c.donec)
 }
 
-func (c *Cache) deleteItem(bucket *bucket, item *Item) bool {
-	_, ok := bucket.delete(item.key) //stop other GETs from getting it
+func (c *Cache) deleteItem(bucket *bucket, item *Item, reason RemovalReason, score float64) bool {
+	ok := bucket.deleteItem(item) //stop other GETs from getting it
 	if ok {
 		//c.deletables <- item
-		c.afterDelete(item)
+		c.afterDelete(item, reason, score)
 	}
 	return ok
 }
 
-func (c *Cache) set(key string, value interface{}, r *ReqInfo, duration time.Duration) *Item {
-	item, existing := c.bucket(key).set(key, value, r, duration)
+// Creates an item sized as MaxSize or MaxMemory count it
+func (c *Cache) newItem(key string, value interface{}, r *ReqInfo, expires int64) *Item {
+	item := newItem(key, value, r, expires)
+	if c.memory {
+		item.size = entryMemory(key, value)
+	}
+	return item
+}
+
+// Sets the item, and returns it along with whether it was cached. It isn't
+// when the TinyLFU filter refuses it, or when it would replace a tracked item,
+// but the caller still gets it.
+func (c *Cache) set(key string, value interface{}, r *ReqInfo, duration time.Duration) (*Item, bool) {
+	item := c.newItem(key, value, r, time.Now().Add(duration).UnixNano())
+	if c.filter != nil {
+		c.filter.increment(hashKey64(key))
+		if !c.admit([]*Item{item}) {
+			c.bucket(key).stats.reject()
+			return item, false
+		}
+	}
+	return item, c.setItem(item)
+}
+
+// Whether the TinyLFU filter lets the new items in. They always get in while
+// they fit, counting the room freed by the items they replace. Otherwise the
+// least popular of their keys which aren't cached yet must be more popular
+// than every item evict would pick to make room for them: prune evicts at
+// least itemsToPrune items, and as many as needed to get back under the max
+// size, in the units it enforces.
+func (c *Cache) admit(items []*Item) bool {
+	size, freq := int64(0), -1
+	for _, item := range items {
+		size += item.size
+		if existing := c.bucket(item.key).peek(item.key); existing != nil {
+			size -= existing.size
+			continue
+		}
+		if f := c.filter.estimate(hashKey64(item.key)); freq == -1 || f < freq {
+			freq = f
+		}
+	}
+	if freq == -1 || atomic.LoadInt64(&c.size)+size <= c.capacity() {
+		// only replacing cached items, or there is room for them
+		return true
+	}
+	for _, victim := range c.evictor.victims(&c.size, size, c) {
+		if freq <= c.filter.estimate(hashKey64(victim.key)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Stores the item, returning false if it was left out to keep a tracked item
+// of its key in place
+func (c *Cache) setItem(item *Item) bool {
+	bucket := c.bucket(item.key)
+	existing, stored, ok := bucket.setItem(item)
+	for !ok {
+		// resharded in the meantime
+		bucket = c.bucket(item.key)
+		existing, stored, ok = bucket.setItem(item)
+	}
+	if !stored {
+		bucket.stats.keep()
+		return false
+	}
+	bucket.stats.set(item)
 	if existing != nil {
 		//c.deletables <- existing
-		c.afterDelete(existing)
+		c.afterDelete(existing, RemovedReplaced, 0)
 	}
 	c.introduce(item)
-	return item
+	return true
 }
 
+// The bucket of the key. While resharding, that's the new bucket once the
+// old one moved.
 func (c *Cache) bucket(key string) *bucket {
-	h := fnv.New32a()
-	h.Write([]byte(key))
-	return c.buckets[h.Sum32()&c.bucketMask]
+	return c.hashedBucket(hashKey(key, c.keyHasher))
+}
+
+// The bucket of the keys which hash to h
+func (c *Cache) hashedBucket(h uint32) *bucket {
+	for {
+		t := c.table()
+		bucket := t.buckets[h&t.mask]
+		if !bucket.isMoved() {
+			return bucket
+		}
+		if m := c.migrating(); m != nil && m.from == t {
+			return m.to.buckets[h&m.to.mask]
+		}
+		// the migration completed since the table was loaded
+	}
+}
+
+// The index of the key's bucket in the current buckets
+func (c *Cache) bucketIndex(key string) int {
+	return c.table().index(key)
 }
 
 func (c *Cache) introduce(item *Item) {
 	//c.promotables <- item
 
 	c.atInsert(item)
+	if c.backends.enforced {
+		c.enforceQuota(item)
+	}
 	c.evict()
 }
 
@@ -201,145 +412,118 @@ func (c *Cache) introduce(item *Item) {
 //	}
 //}
 
-func (c *Cache) afterDelete(item *Item) {
+// score is the evaluator's score of an item it picked for eviction, 0 for
+// every other removal
+func (c *Cache) afterDelete(item *Item, reason RemovalReason, score float64) {
 
 	atomic.AddInt64(&c.size, -item.size)
+	c.backends.remove(item)
+	c.evicted(item, reason, score)
 
 	if c.onDelete != nil {
+		// a tracked item is only cleaned up once it has been released
+		if c.tracking && item.orphan(c.onDelete) {
+			return
+		}
 		c.onDelete(item)
 	}
 }
 
+// Calls OnEvict
+func (c *Cache) evicted(item *Item, reason RemovalReason, score float64) {
+	if c.onEvict != nil {
+		c.onEvict(item, reason, score)
+	}
+}
+
 func (c *Cache) atInsert(item *Item) {
 
 	atomic.AddInt64(&c.size, item.size)
+	c.backends.insert(item)
+	if c.observer != nil {
+		c.observer.OnSet(item)
+	}
 }
 
 func (c *Cache) buildSamplingTables() *samplingTables {
-	n := c.Configuration.buckets
-	tableU := make([]float64, n, n)
-	tableK := make([]int, n, n)
-
-	for i := range tableK {
-		tableK[i] = -1
+	buckets := c.samplingBuckets()
+	nums := make([]int, len(buckets))
+	for i, bucket := range buckets {
+		nums[i] = bucket.getNum()
 	}
+	return buildSamplingTables(nums)
+}
 
-	overfull := []int{}
-	underfull := []int{}
-
-	sum := 0
-	for i := range tableU {
-		num := c.buckets[i].getNum()
-		sum += num
-		tableU[i] = float64(n) * float64(num)
+func (c *Cache) evict() {
+	if c.backends.enforced {
+		c.evictOverShare()
 	}
+	c.evictor.evict(&c.size, c)
+}
 
-	for i := range tableU {
-		tableU[i] /= float64(sum)
-
-		if tableU[i] - 1 > EPSILON {
-			overfull = append(overfull, i)
-		} else if tableU[i] < 1 - EPSILON && tableK[i] < 0 {
-			underfull = append(underfull, i)
-		} else {
-			tableK[i] = i
-		}
+func (c *Cache) evictionCandidate(bucket int) (*Item, float64) {
+	buckets := c.samplingBuckets()
+	if bucket >= len(buckets) {
+		// sampling tables built before a Reshard completed
+		return nil, 0
 	}
+	item, val := buckets[bucket].getCandidate(c.eval)
+	if item != nil && ((c.tracking && item.pinned()) || c.backends.protected(item)) {
+		return nil, 0
+	}
+	return item, val
+}
 
-	for len(overfull) > 0 {
-		i := overfull[len(overfull) - 1]
-		overfull = overfull[:len(overfull) - 1]
-		j := underfull[len(underfull) - 1]
-		underfull = underfull[:len(underfull) - 1]
-
-		tableK[j] = i
-		tableU[i] = tableU[i] + tableU[j] - 1
-
-		if tableU[i] - 1 > EPSILON {
-			overfull = append(overfull, i)
-		} else if tableU[i] < 1 - EPSILON && tableK[i] < 0 {
-			underfull = append(underfull, i)
-		} else {
-			tableK[i] = i
-		}
+func (c *Cache) rescore(bucket int, item *Item) (float64, bool) {
+	if !c.bucket(item.key).contains(item) || (c.tracking && item.pinned()) || c.backends.protected(item) {
+		return 0, false
 	}
+	return c.eval.Eval(item), true
+}
 
-	return &samplingTables{tableU, tableK}
+func (c *Cache) evictItem(bucket int, item *Item, score float64) {
+	c.evictFor(item, EvictedForSpace, score)
 }
 
-func (c *Cache) evict() {
-	s := atomic.LoadInt64(&c.size)
-	if s <= c.maxSize {
-		return
+// Evicts the item, which was given score by the evaluator, counting it under
+// reason unless it had expired. Returns false if it was no longer cached.
+func (c *Cache) evictFor(item *Item, reason EvictionReason, score float64) bool {
+	if item.Expired() {
+		reason = EvictedExpired
 	}
-
-	tables := atomic.LoadPointer(&c.tables)
-	if tables  == nil {
-		tables = unsafe.Pointer(c.buildSamplingTables())
-		atomic.CompareAndSwapPointer(&c.tables, nil, tables)
-	} else if cnt := atomic.LoadUint64(&c.counter); cnt >= c.countPerSampling {
-		for !atomic.CompareAndSwapUint64(&c.counter, cnt, 0) {
-			cnt = atomic.LoadUint64(&c.counter)
-			if cnt < c.countPerSampling {
-				tables = atomic.LoadPointer(&c.tables)
-				goto skip
-			}
-		}
-		tables = unsafe.Pointer(c.buildSamplingTables())
-		atomic.StorePointer(&c.tables, tables)
+	b := c.bucket(item.key)
+	if c.deleteItem(b, item, reason.removal(), score) == false {
+		return false
 	}
+	b.stats.evict(item, reason)
+	if c.observer != nil {
+		c.observer.OnEvict(item)
+	}
+	if item.page != nil {
+		c.evictPage(item)
+	}
+	return true
+}
 
-skip:
-	tableU := (*samplingTables)(tables).tableU
-	tableK := (*samplingTables)(tables).tableK
-
-	ii := 0
-	for s = atomic.LoadInt64(&c.size); s > c.maxSize || ii < c.itemsToPrune; s = atomic.LoadInt64(&c.size) {
-
-		var minBucket int
-		var minItem *Item
-		var minVal float64
-
-		for j := 0; j < c.candidates; j++ {
-
-			bucket := -1
-
-			// Alias method
-			x := rand.Float64()
-			n := c.Configuration.buckets
-
-			i := int(float64(n) * x)
-			y := float64(n) * x - float64(i)
-			if y < tableU[i] {
-				bucket = i
-			} else {
-				bucket = tableK[i]
-			}
-
-			curItem, curVal := c.buckets[bucket].getCandidate(c.eval)
-
-			if curItem != nil {
-				if minItem == nil {
-					minItem = curItem
-					minVal = curVal
-					minBucket = bucket
-				} else {
-					if curVal < minVal {
-						minItem = curItem
-						minVal = curVal
-						minBucket = bucket
-					}
-				}
-			}
-			// Possible nil result, purposely left there to avoid infinite loop
+// Evicts the objects which were set along with the victim by SetPage, since
+// their page can no longer be fully hit. Objects which have since been set
+// again, as part of another page or not, are left alone, like the objects
+// eviction can't pick: tracked ones and those of backends under their minimum.
+func (c *Cache) evictPage(victim *Item) {
+	for _, key := range victim.page.keys {
+		if key == victim.key {
+			continue
 		}
-
-		if minItem != nil {
-			if _, ok := c.buckets[minBucket].delete(minItem.key); ok {
-				c.afterDelete(minItem)
+		bucket := c.bucket(key)
+		item := bucket.peek(key)
+		if item == nil || item.page != victim.page || (c.tracking && item.pinned()) || c.backends.protected(item) {
+			continue
+		}
+		if c.deleteItem(bucket, item, RemovedEvicted, 0) {
+			bucket.stats.evict(item, EvictedWithPage)
+			if c.observer != nil {
+				c.observer.OnEvict(item)
 			}
 		}
-
-		ii++
 	}
-}
\ No newline at end of file
+}
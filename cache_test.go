@@ -1,6 +1,8 @@
 package ccache
 
 import (
+	"bytes"
+	"strconv"
 	"testing"
 	"time"
 
@@ -44,6 +46,64 @@ func (_ CacheTests) OnDeleteCallbackCalled() {
 	Expect(onDeleteFnCalled).To.Equal(true)
 }
 
+func (_ CacheTests) OnEvictReportsDeletesReplacesAndClears() {
+	removed := recordRemovals()
+	cache := New(removed.configure(Configure()))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("spice", "must", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	cache.Delete("worm")
+	cache.SetPage(page(1, 1), time.Minute)
+	cache.DeleteBackend(1)
+	Expect(removed.reasons).To.Equal(map[interface{}]RemovalReason{"flow": RemovedReplaced, "sand": RemovedDeleted, 1: RemovedDeleted})
+
+	var buf bytes.Buffer
+	cache.Snapshot(&buf)
+	cache.RestoreFrom(&buf)
+	Expect(removed.reasons["must"]).To.Equal(RemovedReplaced)
+	cache.Clear()
+	Expect(removed.reasons["must"]).To.Equal(RemovedCleared)
+	// items which weren't picked for eviction aren't scored
+	Expect(removed.scores["must"]).To.Equal(0.0)
+	Expect(removed.evals).To.Equal(0)
+}
+
+func (_ CacheTests) OnEvictReportsEvictionsAndTheirScore() {
+	removed := recordRemovals()
+	cache := New(removed.configure(Configure().MaxSize(10).ItemsToPrune(1).PageEviction(true)))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", &SizedItem{1, 10}, time.Minute)
+	Expect(len(removed.reasons)).To.Equal(1)
+	for value, reason := range removed.reasons {
+		Expect(reason).To.Equal(RemovedEvicted)
+		Expect(removed.scores[value]).To.Equal(float64(getValueSize(value)))
+	}
+
+	cache.Clear()
+	removed.reset()
+	cache.Set("dead", "sand", -time.Minute)
+	Expect(cache.sweepPass(10)).To.Equal(1)
+	cache.SetPage([]*Request{{Backend: 1, Uri: 1, Obj: "a"}, {Backend: 1, Uri: 2, Obj: "b"}}, time.Minute)
+	cache.evictItem(0, cache.Get(buildKey(1, 1)), 7)
+	Expect(removed.reasons).To.Equal(map[interface{}]RemovalReason{"sand": RemovedExpired, "a": RemovedEvicted, "b": RemovedEvicted})
+	Expect(removed.scores).To.Equal(map[interface{}]float64{"sand": 0, "a": 7, "b": 0})
+
+	cache.Set("dead", "sand", -time.Minute)
+	cache.evictItem(0, cache.Get("dead"), 3)
+	Expect(removed.reasons["sand"]).To.Equal(RemovedExpired)
+	Expect(removed.scores["sand"]).To.Equal(3.0)
+}
+
+func (_ CacheTests) OnEvictReportsQuotaEvictions() {
+	removed := recordRemovals()
+	cache := New(removed.configure(Configure().BackendQuota(1, 0, 2)))
+	small, big := &SizedItem{1, 1}, &SizedItem{2, 2}
+	cache.SetPage([]*Request{{Backend: 1, Uri: 1, Obj: small}}, time.Minute)
+	cache.SetPage([]*Request{{Backend: 1, Uri: 2, Obj: big}}, time.Minute)
+	Expect(removed.reasons).To.Equal(map[interface{}]RemovalReason{small: RemovedEvicted})
+	Expect(removed.scores[small]).To.Equal(1.0)
+}
+
 func (_ CacheTests) FetchesExpiredItems() {
 	cache := New(Configure())
 	fn := func() (interface{}, error) { return "moo-moo", nil }
@@ -81,20 +141,70 @@ func (_ CacheTests) FetchesExpiredItems() {
 //	Expect(cache.Get("11").Value()).To.Equal(11)
 //}
 
-//func (_ CacheTests) TrackerDoesNotCleanupHeldInstance() {
-//	cache := New(Configure().ItemsToPrune(10).Track())
-//	for i := 0; i < 10; i++ {
-//		cache.Set(strconv.Itoa(i), i, time.Minute)
-//	}
-//	item := cache.TrackingGet("0")
-//	time.Sleep(time.Millisecond * 10)
-//	gcCache(cache)
-//	Expect(cache.Get("0").Value()).To.Equal(0)
-//	Expect(cache.Get("1")).To.Equal(nil)
-//	item.Release()
-//	gcCache(cache)
-//	Expect(cache.Get("0")).To.Equal(nil)
-//}
+func (_ CacheTests) TrackerDoesNotCleanupHeldInstance() {
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1).Track())
+	cache.Set("0", 0, time.Minute)
+	item := cache.TrackingGet("0")
+	for i := 1; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	checkSize(cache, 5)
+	Expect(cache.Get("0").Value()).To.Equal(0)
+	item.Release()
+	Expect(cache.Get("0").Value()).To.Equal(0)
+}
+
+func (_ CacheTests) ReportsOverflowWhenEverythingIsTracked() {
+	cache := New(Configure().ItemsToPrune(1).Track())
+	cache.Set("0", 0, time.Minute)
+	cache.Set("1", 1, time.Minute)
+	item0 := cache.TrackingGet("0")
+	item1 := cache.TrackingGet("1")
+
+	cache.params.maxSize = 1
+	cache.evict()
+	Expect(cache.Overflowing()).To.Equal(true)
+	checkSize(cache, 2)
+
+	item0.Release()
+	item1.Release()
+	cache.evict()
+	Expect(cache.Overflowing()).To.Equal(false)
+	checkSize(cache, 1)
+}
+
+func (_ CacheTests) OnDeleteWaitsForTrackedItemsToBeReleased() {
+	deleted := 0
+	cache := New(Configure().Track().OnDelete(func(item *Item) { deleted++ }))
+	cache.Set("spice", "flow", time.Minute)
+	item := cache.TrackingGet("spice")
+
+	cache.Delete("spice")
+	Expect(deleted).To.Equal(0)
+	Expect(item.Value()).To.Equal("flow")
+	Expect(cache.Get("spice")).To.Equal(nil)
+	item.Release()
+	Expect(deleted).To.Equal(1)
+}
+
+func (_ CacheTests) SetsLeaveTrackedItemsInPlace() {
+	deleted := 0
+	cache := New(Configure().Track().OnDelete(func(item *Item) { deleted++ }))
+	cache.Set("spice", "flow", time.Minute)
+	item := cache.TrackingGet("spice")
+
+	cache.Set("spice", "must", time.Minute)
+	Expect(cache.Replace("spice", "gold")).To.Equal(false)
+	Expect(cache.Get("spice")).To.Equal(item)
+	Expect(cache.Stats().NotReplaced).To.Equal(uint64(2))
+	Expect(deleted).To.Equal(0)
+	checkSize(cache, 1)
+
+	item.Release()
+	Expect(cache.Replace("spice", "must")).To.Equal(true)
+	Expect(cache.Get("spice").Value()).To.Equal("must")
+	Expect(deleted).To.Equal(1)
+}
 
 //func (_ CacheTests) RemovesOldestItemWhenFull() {
 //	cache := New(Configure().MaxSize(5).ItemsToPrune(1))
@@ -177,6 +287,38 @@ func (s *SizedItem) Size() int64 {
 	return s.s
 }
 
+// What OnEvict was told, by the removed items' values. Items are scored by
+// their size.
+type removalLog struct {
+	reasons map[interface{}]RemovalReason
+	scores  map[interface{}]float64
+	// how many times items were scored
+	evals int
+}
+
+func recordRemovals() *removalLog {
+	l := &removalLog{}
+	l.reset()
+	return l
+}
+
+func (l *removalLog) configure(config *Configuration) *Configuration {
+	return config.Evaluator(EvalFunc(func(item *Item) float64 {
+		l.evals++
+		return float64(item.Size())
+	})).
+		OnEvict(func(item *Item, reason RemovalReason, score float64) {
+			l.reasons[item.Value()] = reason
+			l.scores[item.Value()] = score
+		})
+}
+
+func (l *removalLog) reset() {
+	l.reasons = make(map[interface{}]RemovalReason)
+	l.scores = make(map[interface{}]float64)
+	l.evals = 0
+}
+
 func checkSize(cache *Cache, sz int64) {
 	cache.Stop()
 	Expect(cache.size).To.Equal(sz)
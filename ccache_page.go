@@ -17,17 +17,118 @@ type Request struct {
 // will be negative for an already expired item).
 func (c *Cache) GetPage(reqs []*Request) error {
 
+	hits := 0
+	var waiting []pageWait
+	var buf [maxPageKeySize]byte
 	for _, req := range reqs {
-		key := buildKey(req.Backend, req.Uri)
+		// the key only lives for the lookup, so it stays on the stack
+		key := string(putKey(&buf, req.Backend, req.Uri))
 
-		item := c.Get(key)
+		item := c.get(c.hashedBucket(hashPage(req.Backend, req.Uri)), key)
 		if item == nil {
+			if c.coalescePages > 0 {
+				key := buildKey(req.Backend, req.Uri)
+				if fl, leader := c.flights.claim(key); leader == false {
+					waiting = append(waiting, pageWait{req, key, fl})
+				}
+			}
 			continue
 		}
 
 		req.Obj = item.value
+		// expired objects are still returned, but count as misses like they
+		// do for Get
+		if !item.Expired() {
+			hits++
+		}
+	}
+
+	if len(waiting) > 0 {
+		deadline := time.Now().Add(c.coalescePages)
+		for _, w := range waiting {
+			c.flights.wait(w.key, w.flight, deadline)
+			if w.flight.value != nil {
+				w.req.Obj = w.flight.value
+				hits++
+			}
+		}
 	}
 
+	c.pages.page(hits, len(reqs))
+	return nil
+}
+
+// A GetPage miss waiting for another caller's load
+type pageWait struct {
+	req    *Request
+	key    string
+	flight *flight
+}
+
+// Gives up on loading the requests a GetPage missed. Only needed with
+// CoalescePages, where callers waiting for those objects are then told about
+// the miss right away.
+func (c *Cache) AbandonPage(reqs []*Request) {
+	for _, req := range reqs {
+		c.flights.complete(buildKey(req.Backend, req.Uri), nil, nil, nil)
+	}
+}
+
+// Read-through for pages: looks the requests up like GetPage, then calls
+// loader with only the requests which were missed. The loader sets Obj on the
+// requests it could load and leaves it nil on the others. Whatever was loaded
+// is then set like SetPageWithMissingSize does, with the size of the page's
+// objects as its request size and the size of the loaded ones as the missing
+// size. The hits are left as they are, and requests left without an Obj
+// aren't cached. If loader fails, nothing is set and its error is returned.
+func (c *Cache) FetchPage(reqs []*Request, duration time.Duration, loader func(missing []*Request) error) error {
+	if err := c.GetPage(reqs); err != nil {
+		return err
+	}
+	var missing []*Request
+	for _, req := range reqs {
+		if req.Obj == nil {
+			missing = append(missing, req)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	loaded := false
+	defer func() {
+		if !loaded {
+			// release the callers waiting on the missing objects, even if
+			// loader panics
+			c.AbandonPage(missing)
+		}
+	}()
+	if err := loader(missing); err != nil {
+		return err
+	}
+	loaded = true
+
+	size, missingSize := int64(0), int64(0)
+	for _, req := range reqs {
+		if req.Obj != nil {
+			size += getValueSize(req.Obj)
+		}
+	}
+	var found, notFound []*Request
+	for _, req := range missing {
+		if req.Obj == nil {
+			notFound = append(notFound, req)
+		} else {
+			missingSize += getValueSize(req.Obj)
+			found = append(found, req)
+		}
+	}
+	if len(notFound) > 0 {
+		c.AbandonPage(notFound)
+	}
+	if len(found) > 0 {
+		c.setMissing(found, &ReqInfo{time.Now(), float64(size), float64(missingSize)}, duration)
+	}
 	return nil
 }
 
@@ -41,23 +142,12 @@ func (c *Cache) SetPage(reqs []*Request, duration time.Duration) {
 	}
 
 	info := &ReqInfo{time.Now(), float64(size), float64(size)}
-
-	for _, req := range reqs {
-		key := buildKey(req.Backend, req.Uri)
-		value := req.Obj
-		c.SetWithInfo(key, value, info, duration)
-	}
+	c.setPage(reqs, info, duration)
 }
 
 // Set the value in the cache for the specified duration
 func (c *Cache) SetPageWithMissingSize(reqs []*Request, missingSize float64, duration time.Duration) {
 
-	if c.admissionPolicy {
-		if float64(atomic.LoadInt64(&c.size)) + missingSize > float64(c.maxSize) && missingSize > float64(c.admissionThres) {
-			return
-		}
-	}
-
 	size := int64(0)
 
 	for _, req := range reqs {
@@ -65,11 +155,58 @@ func (c *Cache) SetPageWithMissingSize(reqs []*Request, missingSize float64, dur
 	}
 
 	info := &ReqInfo{time.Now(), float64(size), missingSize}
+	c.setMissing(reqs, info, duration)
+}
 
+// Sets the requests, unless the admission policy refuses their missing size
+func (c *Cache) setMissing(reqs []*Request, info *ReqInfo, duration time.Duration) {
+	if c.admissionPolicy {
+		if float64(atomic.LoadInt64(&c.size)) + info.MissingSize > float64(c.capacity()) && info.MissingSize > float64(c.admissionThres) {
+			c.rejectPage(reqs, info.MissingSize)
+			return
+		}
+	}
+	c.setPage(reqs, info, duration)
+}
+
+func (c *Cache) setPage(reqs []*Request, info *ReqInfo, duration time.Duration) {
+	keys := make([]string, len(reqs))
+	for i, req := range reqs {
+		keys[i] = buildKey(req.Backend, req.Uri)
+	}
+	var page *pageGroup
+	if c.pageEviction && len(reqs) > 1 {
+		page = &pageGroup{keys}
+	}
+	// the items are sized before the filter weighs them, in the units the
+	// cache enforces
+	expires := time.Now().Add(duration).UnixNano()
+	items := make([]*Item, len(reqs))
+	for i, req := range reqs {
+		items[i] = c.newItem(keys[i], req.Obj, info, expires)
+		items[i].page = page
+	}
+	if c.filter != nil {
+		for _, key := range keys {
+			c.filter.increment(hashKey64(key))
+		}
+		if !c.admit(items) {
+			c.rejectPage(reqs, info.MissingSize)
+			return
+		}
+	}
+	for i, item := range items {
+		atomic.AddUint64(&c.counter, 1)
+		c.setItem(item)
+		c.flights.complete(keys[i], item, reqs[i].Obj, nil)
+	}
+}
+
+func (c *Cache) rejectPage(reqs []*Request, missingSize float64) {
+	c.pages.reject(missingSize)
+	// not cached, but callers waiting for the page can still have it
 	for _, req := range reqs {
-		key := buildKey(req.Backend, req.Uri)
-		value := req.Obj
-		c.SetWithInfo(key, value, info, duration)
+		c.flights.complete(buildKey(req.Backend, req.Uri), nil, req.Obj, nil)
 	}
 }
 
@@ -80,13 +217,15 @@ func (c *Cache) SetWithInfo(key string, value interface{}, r *ReqInfo, duration
 }
 
 // Replace the value if it exists, does not set if it doesn't.
-// Returns true if the item existed an was replaced, false otherwise.
+// Returns true if the item existed an was replaced, false otherwise, which
+// includes a tracked item left in place.
 // Replace does not reset item's TTL
 func (c *Cache) ReplaceWithInfo(key string, r *ReqInfo, value interface{}) bool {
 	item := c.bucket(key).get(key)
 	if item == nil {
 		return false
 	}
-	c.SetWithInfo(key, value, r, item.TTL())
-	return true
+	atomic.AddUint64(&c.counter, 1)
+	_, replaced := c.set(key, value, r, item.TTL())
+	return replaced
 }
\ No newline at end of file
@@ -0,0 +1,252 @@
+package ccache
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type PageTests struct{}
+
+func Test_Page(t *testing.T) {
+	Expectify(new(PageTests), t)
+}
+
+func (_ PageTests) FetchPageLoadsOnlyTheMissingObjects() {
+	deleted := 0
+	cache := New(Configure().OnDelete(func(item *Item) { deleted++ }))
+	cache.SetPage([]*Request{{Backend: 1, Uri: 1, Obj: &SizedItem{1, 4}}}, time.Minute)
+	hit := cache.Get(buildKey(1, 1))
+
+	var loaded []uint64
+	page := []*Request{{Backend: 1, Uri: 1}, {Backend: 1, Uri: 2}, {Backend: 1, Uri: 3}}
+	err := cache.FetchPage(page, time.Minute, func(missing []*Request) error {
+		for _, req := range missing {
+			loaded = append(loaded, req.Uri)
+			req.Obj = &SizedItem{int(req.Uri), 2}
+		}
+		return nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(loaded).To.Equal([]uint64{2, 3})
+	Expect(page[0].Obj.(*SizedItem).id).To.Equal(1)
+	Expect(page[2].Obj.(*SizedItem).id).To.Equal(3)
+
+	for uri := uint64(2); uri <= 3; uri++ {
+		info := cache.Get(buildKey(1, uri)).ReqInfo()
+		Expect(info.ReqSize).To.Equal(8.0)
+		Expect(info.MissingSize).To.Equal(4.0)
+	}
+	// the hit is left as it was
+	Expect(cache.Get(buildKey(1, 1))).To.Equal(hit)
+	Expect(hit.ReqInfo().ReqSize).To.Equal(4.0)
+	Expect(deleted).To.Equal(0)
+}
+
+func (_ PageTests) FetchPageDoesntCallTheLoaderOnAFullHit() {
+	cache := New(Configure())
+	cache.SetPage([]*Request{{Backend: 1, Uri: 1, Obj: "a"}}, time.Minute)
+	page := []*Request{{Backend: 1, Uri: 1}}
+	err := cache.FetchPage(page, time.Minute, func(missing []*Request) error {
+		panic("loader called")
+	})
+	Expect(err).To.Equal(nil)
+	Expect(page[0].Obj).To.Equal("a")
+	Expect(cache.Stats().PageHits).To.Equal(uint64(1))
+}
+
+func (_ PageTests) FetchPageDoesntCacheWhatTheLoaderCouldntFind() {
+	cache := New(Configure())
+	page := []*Request{{Backend: 1, Uri: 1}, {Backend: 1, Uri: 2}}
+	err := cache.FetchPage(page, time.Minute, func(missing []*Request) error {
+		missing[0].Obj = "a"
+		return nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(cache.Get(buildKey(1, 1)).Value()).To.Equal("a")
+	Expect(cache.Get(buildKey(1, 2))).To.Equal(nil)
+	Expect(cache.size).To.Equal(int64(1))
+}
+
+func (_ PageTests) FetchPageReturnsLoaderErrors() {
+	cache := New(Configure().CoalescePages(time.Minute))
+	page := []*Request{{Backend: 1, Uri: 1}}
+	err := cache.FetchPage(page, time.Minute, func(missing []*Request) error {
+		missing[0].Obj = "a"
+		return errors.New("backend down")
+	})
+	Expect(err.Error()).To.Equal("backend down")
+	Expect(cache.Get(buildKey(1, 1))).To.Equal(nil)
+
+	// the flight was abandoned, so the next caller doesn't wait for it
+	start := time.Now()
+	cache.GetPage([]*Request{{Backend: 1, Uri: 1}})
+	Expect(time.Since(start) < time.Second).To.Equal(true)
+}
+
+func (_ PageTests) FetchPageAppliesTheAdmissionPolicy() {
+	cache := New(Configure().MaxSize(10).AdmissionPolicy(true).AdmissionThres(5))
+	page := []*Request{{Backend: 1, Uri: 1}}
+	err := cache.FetchPage(page, time.Minute, func(missing []*Request) error {
+		missing[0].Obj = &SizedItem{1, 20}
+		return nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(page[0].Obj.(*SizedItem).id).To.Equal(1)
+	Expect(cache.Get(buildKey(1, 1))).To.Equal(nil)
+	Expect(cache.Stats().Rejections).To.Equal(uint64(1))
+}
+
+func (_ PageTests) PageEvictionEvictsTheWholePage() {
+	cache := New(Configure().PageEviction(true))
+	cache.SetPage(page(1, 1, 2, 3), time.Minute)
+	cache.SetPage(page(2, 1), time.Minute)
+	victim := cache.Get(buildKey(1, 2))
+	cache.evictItem(cache.bucketIndex(victim.key), victim, 0)
+
+	Expect(cache.Get(buildKey(1, 1))).To.Equal(nil)
+	Expect(cache.Get(buildKey(1, 3))).To.Equal(nil)
+	Expect(cache.Get(buildKey(2, 1)).Value()).To.Equal(1)
+	Expect(cache.size).To.Equal(int64(1))
+	stats := cache.Stats()
+	Expect(stats.Evictions[EvictedForSpace]).To.Equal(uint64(1))
+	Expect(stats.Evictions[EvictedWithPage]).To.Equal(uint64(2))
+}
+
+func (_ PageTests) PageEvictionLeavesObjectsSetAgainAlone() {
+	cache := New(Configure().PageEviction(true))
+	cache.SetPage(page(1, 1, 2), time.Minute)
+	cache.Set(buildKey(1, 1), "again", time.Minute)
+	victim := cache.Get(buildKey(1, 2))
+	cache.evictItem(cache.bucketIndex(victim.key), victim, 0)
+	Expect(cache.Get(buildKey(1, 1)).Value()).To.Equal("again")
+}
+
+func (_ PageTests) PageEvictionKeepsTheMinimumOfBackends() {
+	cache := New(Configure().PageEviction(true).BackendQuota(2, 1, 0))
+	cache.SetPage(append(page(1, 1), page(2, 1)...), time.Minute)
+	victim := cache.Get(buildKey(1, 1))
+	cache.evictItem(cache.bucketIndex(victim.key), victim, 0)
+	Expect(cache.Get(buildKey(2, 1)).Value()).To.Equal(1)
+	Expect(cache.Stats().Evictions[EvictedWithPage]).To.Equal(uint64(0))
+}
+
+func (_ PageTests) PageEvictionImprovesThePageHitRatio() {
+	plain := replayPages(Configure())
+	paged := replayPages(Configure().PageEviction(true))
+	Expect(paged.PageHitRatio() > plain.PageHitRatio()).To.Equal(true)
+	Expect(paged.PartialPageHits < plain.PartialPageHits).To.Equal(true)
+}
+
+func (_ PageTests) KeysEncodeTheBackendAndUri() {
+	key := buildKey(1<<40|7, 9)
+	Expect(key).To.Equal("1099511627783:9")
+	backend, uri, err := parseKey(key)
+	Expect(err).To.Equal(nil)
+	Expect(backend).To.Equal(uint64(1<<40 | 7))
+	Expect(uri).To.Equal(uint64(9))
+	Expect(hashKey(key, HashString)).To.Equal(hashPage(1<<40|7, 9))
+	Expect(buildKey(1<<64-1, 0)).To.Equal("18446744073709551615:0")
+
+	// a page has a single key
+	for _, key := range []string{"01:9", "1:09", "1:", ":9", "1:9:", "1:-9", "18446744073709551616:0", "\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x09"} {
+		_, _, err = parseKey(key)
+		Expect(err).Not.To.Equal(nil)
+		Expect(hashKey(key, HashString)).To.Equal(HashString(key))
+	}
+}
+
+func (_ PageTests) SetAndGetSharePageKeys() {
+	cache := New(Configure())
+	cache.SetPage(page(1, 1), time.Minute)
+	item := cache.Get("1:1")
+	Expect(item.Value()).To.Equal(1)
+	Expect(item.Key()).To.Equal("1:1")
+
+	cache.Set("1:2", 2, time.Minute)
+	reqs := page(1, 2)
+	reqs[0].Obj = nil
+	cache.GetPage(reqs)
+	Expect(reqs[0].Obj).To.Equal(2)
+}
+
+func (_ PageTests) PageKeysIgnoreTheKeyHasher() {
+	cache := New(Configure().Buckets(8).KeyHasher(func(key string) uint32 { return 3 }))
+	cache.Set("spice", "flow", time.Minute)
+	cache.SetPage(page(1, 1, 2, 3, 4, 5, 6, 7, 8), time.Minute)
+	Expect(cache.bucketIndex("spice")).To.Equal(3)
+	buckets := map[int]bool{}
+	for uri := uint64(1); uri <= 8; uri++ {
+		key := buildKey(1, uri)
+		Expect(cache.bucket(key).peek(key).Value()).To.Equal(int(uri))
+		buckets[cache.bucketIndex(key)] = true
+	}
+	Expect(len(buckets) > 1).To.Equal(true)
+}
+
+func (_ PageTests) GetPageDoesntAllocate() {
+	cache := New(Configure())
+	cache.SetPage(page(1, 1, 2, 3), time.Minute)
+	hits, misses := page(1, 1, 2, 3), page(2, 1, 2, 3)
+	Expect(testing.AllocsPerRun(100, func() { cache.GetPage(hits) })).To.Equal(0.0)
+	Expect(testing.AllocsPerRun(100, func() { cache.GetPage(misses) })).To.Equal(0.0)
+	Expect(hits[2].Obj).To.Equal(3)
+}
+
+func BenchmarkGetPage(b *testing.B) {
+	cache := New(Configure().MaxSize(100000))
+	pages := make([][]*Request, 1000)
+	for i := range pages {
+		pages[i] = page(uint64(i), 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+		cache.SetPage(pages[i], time.Minute)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.GetPage(pages[i%len(pages)])
+	}
+}
+
+func BenchmarkSetPage(b *testing.B) {
+	cache := New(Configure().MaxSize(100000))
+	pages := make([][]*Request, 1000)
+	for i := range pages {
+		pages[i] = page(uint64(i), 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.SetPage(pages[i%len(pages)], time.Minute)
+	}
+}
+
+// Reads 40 pages of 5 objects, in a zipf distribution, through a cache which
+// only fits 20 of them
+func replayPages(config *Configuration) Stats {
+	cache := New(config.MaxSize(100).ItemsToPrune(1).Buckets(8).Candidates(4))
+	zipf := rand.NewZipf(rand.New(rand.NewSource(42)), 1.1, 1, 39)
+	for i := 0; i < 20000; i++ {
+		reqs := page(zipf.Uint64(), 1, 2, 3, 4, 5)
+		for _, req := range reqs {
+			req.Obj = nil
+		}
+		cache.FetchPage(reqs, time.Minute, func(missing []*Request) error {
+			for _, req := range missing {
+				req.Obj = int(req.Uri)
+			}
+			return nil
+		})
+	}
+	return cache.Stats()
+}
+
+func page(backend uint64, uris ...uint64) []*Request {
+	reqs := make([]*Request, len(uris))
+	for i, uri := range uris {
+		reqs[i] = &Request{Backend: backend, Uri: uri, Obj: int(uri)}
+	}
+	return reqs
+}
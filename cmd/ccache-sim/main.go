@@ -0,0 +1,179 @@
+// ccache-sim replays a trace through ccache with various settings and
+// reports the object, byte and page hit ratios of each side by side.
+//
+// Traces are read with the trace package, -format picks one of its formats.
+// The default page format has one page per line, each page being a whitespace
+// separated list of backend:uri:size entries.
+//
+//	ccache-sim -trace pages.txt -algorithms lfu,h1,h2 -sizes 1000000,10000000
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karlseguin/ccache/trace"
+)
+
+func main() {
+	traceFile := flag.String("trace", "-", "trace file, - for stdin")
+	format := flag.String("format", "page", "trace format: "+strings.Join(trace.Formats, ", "))
+	blockSize := flag.Int64("block-size", 512, "object size for the block trace formats")
+	algorithms := flag.String("algorithms", "lfu,lru,hyperbolic,h1,h2", "comma separated eval algorithms")
+	sizes := flag.String("sizes", "5000", "comma separated max sizes")
+	candidates := flag.String("candidates", "10", "comma separated candidate counts")
+	countPerSampling := flag.String("count-per-sampling", "1000", "comma separated counts per sampling")
+	admission := flag.String("admission", "false", "comma separated admission policy settings")
+	admissionThres := flag.String("admission-thres", "10240", "comma separated admission thresholds")
+	buckets := flag.Uint("buckets", 16, "number of buckets")
+	ttl := flag.Duration("ttl", 24*time.Hour, "ttl of the cached objects")
+	flag.Parse()
+
+	settings, err := parseSettings(*algorithms, *sizes, *candidates, *countPerSampling, *admission, *admissionThres)
+	if err != nil {
+		fail(err)
+	}
+	for _, s := range settings {
+		if s.candidates > int(*buckets) {
+			fail(fmt.Errorf("%d candidates is more than the %d buckets", s.candidates, *buckets))
+		}
+	}
+
+	in := os.Stdin
+	if *traceFile != "-" {
+		if in, err = os.Open(*traceFile); err != nil {
+			fail(err)
+		}
+		defer in.Close()
+	}
+	reader, err := trace.New(*format, in, *blockSize)
+	if err != nil {
+		fail(err)
+	}
+
+	sims := make([]*simulation, len(settings))
+	for i, s := range settings {
+		sims[i] = newSimulation(s, uint32(*buckets), *ttl)
+	}
+	if err := run(reader, sims); err != nil {
+		fail(err)
+	}
+	report(os.Stdout, sims)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "ccache-sim:", err)
+	os.Exit(1)
+}
+
+// Streams the trace, replaying each page through every simulation
+func run(reader trace.Reader, sims []*simulation) error {
+	return trace.ForEach(reader, func(page *trace.Page) error {
+		if len(page.Requests) == 0 {
+			return nil
+		}
+		for _, sim := range sims {
+			sim.replay(page)
+		}
+		return nil
+	})
+}
+
+// Returns every combination of the comma separated values
+func parseSettings(algorithms, sizes, candidates, countPerSampling, admission, admissionThres string) ([]setting, error) {
+	var settings []setting
+	sizeValues, err := parseInts(sizes)
+	if err != nil {
+		return nil, err
+	}
+	candidateValues, err := parseInts(candidates)
+	if err != nil {
+		return nil, err
+	}
+	countValues, err := parseInts(countPerSampling)
+	if err != nil {
+		return nil, err
+	}
+	thresValues, err := parseInts(admissionThres)
+	if err != nil {
+		return nil, err
+	}
+	var admissionValues []bool
+	for _, value := range split(admission) {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		admissionValues = append(admissionValues, b)
+	}
+
+	for _, algorithm := range split(algorithms) {
+		for _, size := range sizeValues {
+			for _, c := range candidateValues {
+				for _, count := range countValues {
+					for _, a := range admissionValues {
+						for _, thres := range thresValues {
+							settings = append(settings, setting{
+								algorithm:        algorithm,
+								maxSize:          size,
+								candidates:       int(c),
+								countPerSampling: uint64(count),
+								admission:        a,
+								admissionThres:   thres,
+							})
+							if a == false {
+								// the threshold is irrelevant without admission
+								break
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return settings, nil
+}
+
+func parseInts(s string) ([]int64, error) {
+	var values []int64
+	for _, value := range split(s) {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, n)
+	}
+	return values, nil
+}
+
+func split(s string) []string {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func report(out io.Writer, sims []*simulation) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "algorithm\tmax size\tcandidates\tcount/sampling\tadmission\tobject hit\tbyte hit\tpage hit\tmissing bytes/page\t")
+	for _, sim := range sims {
+		r := sim.result()
+		admission := "off"
+		if r.admission {
+			admission = strconv.FormatInt(r.admissionThres, 10)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%.4f\t%.4f\t%.4f\t%.1f\t\n",
+			r.algorithm, r.maxSize, r.candidates, r.countPerSampling, admission,
+			r.objectHitRatio, r.byteHitRatio, r.pageHitRatio, r.missingBytesPerPage)
+	}
+	w.Flush()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karlseguin/ccache/trace"
+	. "github.com/karlseguin/expect"
+)
+
+type SimTests struct{}
+
+func Test_Sim(t *testing.T) {
+	Expectify(new(SimTests), t)
+}
+
+func (_ SimTests) CombinesSettings() {
+	settings, err := parseSettings("lfu,h1", "10,20", "4", "100", "false,true", "5,50")
+	Expect(err).To.Equal(nil)
+	// 2 algorithms * 2 sizes * (1 without admission + 2 thresholds)
+	Expect(len(settings)).To.Equal(12)
+	Expect(settings[0]).To.Equal(setting{"lfu", 10, 4, 100, false, 5})
+	Expect(settings[2]).To.Equal(setting{"lfu", 10, 4, 100, true, 50})
+}
+
+func (_ SimTests) ReplaysPages() {
+	sim := newSimulation(setting{"lfu", 1000, 10, 1000, false, 0}, 16, time.Minute)
+	pages := "1:1:10 1:2:30\n1:1:10 1:2:30\n1:1:10 1:3:60\n"
+	Expect(run(trace.NewPageReader(strings.NewReader(pages)), []*simulation{sim})).To.Equal(nil)
+
+	r := sim.result()
+	Expect(r.objectHitRatio).To.Equal(0.5)
+	Expect(r.byteHitRatio).To.Equal(50.0 / 150)
+	Expect(r.pageHitRatio).To.Equal(1.0 / 3)
+	Expect(r.missingBytesPerPage).To.Equal(100.0 / 3)
+	// only the missing objects were set
+	Expect(sim.cache.Stats().Sets).To.Equal(uint64(3))
+}
+
+func (_ SimTests) CountsExpiredObjectsAsMisses() {
+	sim := newSimulation(setting{"lfu", 1000, 10, 1000, false, 0}, 16, -time.Minute)
+	pages := "1:1:10 1:2:30\n1:1:10 1:2:30\n"
+	Expect(run(trace.NewPageReader(strings.NewReader(pages)), []*simulation{sim})).To.Equal(nil)
+
+	r := sim.result()
+	Expect(r.objectHitRatio).To.Equal(0.0)
+	Expect(r.byteHitRatio).To.Equal(0.0)
+	Expect(r.pageHitRatio).To.Equal(0.0)
+	Expect(r.missingBytesPerPage).To.Equal(40.0)
+}
+
+func (_ SimTests) ReportsEverySimulation() {
+	settings, _ := parseSettings("lfu,lru", "10", "4", "100", "false", "0")
+	sims := []*simulation{newSimulation(settings[0], 16, time.Minute), newSimulation(settings[1], 16, time.Minute)}
+	out := new(bytes.Buffer)
+	report(out, sims)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	Expect(len(lines)).To.Equal(3)
+	Expect(strings.Contains(lines[2], "lru")).To.Equal(true)
+}
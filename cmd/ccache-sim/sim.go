@@ -0,0 +1,120 @@
+package main
+
+import (
+	"time"
+
+	"github.com/karlseguin/ccache"
+	"github.com/karlseguin/ccache/trace"
+)
+
+// A cached object. Its size is what matters to the simulation, its expiry
+// lets the simulation tell expired objects, which GetPage still returns, from
+// hits.
+type object struct {
+	size    int64
+	expires time.Time
+}
+
+func (o *object) Size() int64 {
+	return o.size
+}
+
+type setting struct {
+	algorithm        string
+	maxSize          int64
+	candidates       int
+	countPerSampling uint64
+	admission        bool
+	admissionThres   int64
+}
+
+// Replays pages through a cache configured with one setting. Expired objects
+// count as misses for every ratio, like they do in the cache's Stats.
+type simulation struct {
+	setting
+	cache        *ccache.Cache
+	ttl          time.Duration
+	pages        uint64
+	pagesHit     uint64
+	objects      uint64
+	objectsHit   uint64
+	bytes        uint64
+	bytesHit     uint64
+	missingBytes uint64
+}
+
+func newSimulation(s setting, buckets uint32, ttl time.Duration) *simulation {
+	config := ccache.Configure().
+		Buckets(buckets).
+		MaxSize(s.maxSize).
+		Candidates(s.candidates).
+		CountPerSampling(s.countPerSampling).
+		EvalAlgorithm(s.algorithm).
+		AdmissionPolicy(s.admission).
+		AdmissionThres(s.admissionThres)
+	return &simulation{
+		setting: s,
+		cache:   ccache.New(config),
+		ttl:     ttl,
+	}
+}
+
+// Looks the page up, then sets the objects which were missing or expired,
+// with the size of those objects as the missing size
+func (s *simulation) replay(page *trace.Page) {
+	reqs := make([]*ccache.Request, len(page.Requests))
+	for i, req := range page.Requests {
+		reqs[i] = &ccache.Request{Backend: req.Backend, Uri: req.Uri}
+	}
+	s.cache.GetPage(reqs)
+
+	now := time.Now()
+	var missing []*ccache.Request
+	missingSize := int64(0)
+	for i, req := range reqs {
+		size := page.Sizes[i]
+		s.bytes += uint64(size)
+		if obj, ok := req.Obj.(*object); ok && obj.expires.After(now) {
+			s.objectsHit++
+			s.bytesHit += uint64(size)
+			continue
+		}
+		missingSize += size
+		req.Obj = &object{size, now.Add(s.ttl)}
+		missing = append(missing, req)
+	}
+
+	s.pages++
+	s.objects += uint64(len(reqs))
+	s.missingBytes += uint64(missingSize)
+	if len(missing) == 0 {
+		s.pagesHit++
+		return
+	}
+	s.cache.SetPageWithMissingSize(missing, float64(missingSize), s.ttl)
+}
+
+type result struct {
+	setting
+	objectHitRatio      float64
+	byteHitRatio        float64
+	pageHitRatio        float64
+	missingBytesPerPage float64
+}
+
+func (s *simulation) result() result {
+	return result{
+		setting:             s.setting,
+		objectHitRatio:      ratio(s.objectsHit, s.objects),
+		byteHitRatio:        ratio(s.bytesHit, s.bytes),
+		pageHitRatio:        ratio(s.pagesHit, s.pages),
+		missingBytesPerPage: ratio(s.missingBytes, s.pages),
+	}
+}
+
+func ratio(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
@@ -0,0 +1,151 @@
+package ccache
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+// Hammers the caches from many goroutines. These are mostly useful under the
+// race detector:
+//
+//	go test -race -run Concurrency
+type ConcurrencyTests struct{}
+
+func Test_Concurrency(t *testing.T) {
+	Expectify(new(ConcurrencyTests), t)
+}
+
+const (
+	stressWorkers    = 8
+	stressOperations = 2000
+)
+
+func (_ ConcurrencyTests) CacheWithTheDefaults() {
+	stressCache(New(Configure().MaxSize(100).ItemsToPrune(10)))
+}
+
+func (_ ConcurrencyTests) CacheWithEveryOption() {
+	adaptive, _ := NewAdaptive(64, "lfu", "lru", "h2")
+	stressCache(New(Configure().MaxSize(100).ItemsToPrune(10).Buckets(4).
+		Evaluator(adaptive).EvictionPool(8).TinyLFU(256).PageEviction(true).
+		CoalescePages(time.Millisecond).SweepInterval(time.Millisecond).Track()))
+}
+
+func (_ ConcurrencyTests) CacheEvaluators() {
+	for _, name := range []string{"lru", "hyperbolic", "h1", "h2"} {
+		stressCache(New(Configure().MaxSize(100).ItemsToPrune(10).EvalAlgorithm(name)))
+	}
+}
+
+func (_ ConcurrencyTests) LayeredCache() {
+	cache := Layered(Configure().MaxSize(100).ItemsToPrune(10).EvictionPool(8).Track())
+	stress(func(r *rand.Rand) {
+		primary, secondary := strconv.Itoa(r.Intn(10)), strconv.Itoa(r.Intn(20))
+		switch r.Intn(8) {
+		case 0, 1:
+			if item := cache.Get(primary, secondary); item != nil {
+				item.Value()
+				item.AccessCount()
+			}
+		case 2, 3:
+			cache.Set(primary, secondary, secondary, time.Minute)
+		case 4:
+			cache.Delete(primary, secondary)
+		case 5:
+			cache.Fetch(primary, secondary, time.Minute, func() (interface{}, error) { return secondary, nil })
+		case 6:
+			cache.TrackingGet(primary, secondary).Release()
+		case 7:
+			if r.Intn(20) == 0 {
+				cache.DeleteAll(primary)
+			} else {
+				cache.GetOrCreateSecondaryCache(primary).Set(secondary, secondary, time.Minute)
+			}
+		}
+	})
+	total := int64(0)
+	for _, bucket := range cache.buckets {
+		bucket.RLock()
+		for _, item := range bucket.arr {
+			total += item.size
+		}
+		bucket.RUnlock()
+	}
+	Expect(atomic.LoadInt64(&cache.size)).To.Equal(total)
+}
+
+func stressCache(cache *Cache) {
+	stress(func(r *rand.Rand) {
+		n := r.Intn(200)
+		key := strconv.Itoa(n)
+		switch r.Intn(12) {
+		case 0, 1, 2:
+			if item := cache.Get(key); item != nil {
+				item.Value()
+				item.Expired()
+				item.Accessed()
+			}
+		case 3, 4:
+			cache.Set(key, n, time.Duration(r.Intn(20)-5)*time.Millisecond)
+		case 5:
+			cache.Delete(key)
+		case 6:
+			cache.Fetch(key, time.Minute, func() (interface{}, error) { return n, nil })
+		case 7:
+			cache.FetchStale(key, time.Millisecond, time.Millisecond, func() (interface{}, error) { return n, nil })
+		case 8:
+			cache.TrackingGet(key).Release()
+		case 9:
+			reqs := []*Request{{Backend: uint64(n % 5), Uri: 1}, {Backend: uint64(n % 5), Uri: 2}}
+			cache.FetchPage(reqs, time.Minute, func(missing []*Request) error {
+				for _, req := range missing {
+					req.Obj = n
+				}
+				return nil
+			})
+		case 10:
+			cache.SetPage([]*Request{{Backend: uint64(n % 5), Uri: 3, Obj: n}, {Backend: uint64(n % 5), Uri: 4, Obj: n}}, time.Minute)
+		case 11:
+			if r.Intn(10) == 0 {
+				cache.Snapshot(new(bytes.Buffer))
+			} else {
+				cache.Stats()
+			}
+		}
+	})
+	// let the background refreshes of FetchStale land
+	time.Sleep(time.Millisecond * 10)
+	cache.Stop()
+	total := int64(0)
+	for _, bucket := range cache.table().buckets {
+		bucket.RLock()
+		for _, item := range bucket.arr {
+			total += item.size
+		}
+		bucket.RUnlock()
+	}
+	Expect(atomic.LoadInt64(&cache.size)).To.Equal(total)
+}
+
+// Runs op stressOperations times on each of stressWorkers goroutines
+func stress(op func(r *rand.Rand)) {
+	var wg sync.WaitGroup
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for j := 0; j < stressOperations; j++ {
+				op(r)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+}
@@ -1,6 +1,6 @@
 package ccache
 
-import "strings"
+import "time"
 
 type Configuration struct {
 	maxSize        int64
@@ -11,10 +11,24 @@ type Configuration struct {
 	tracking       bool
 	countPerSampling uint64
 	onDelete       func(item *Item)
+	onEvict        func(item *Item, reason RemovalReason, score float64)
 	updateRatio    float64
-	evalAlgorithm  func(item *Item)float64
+	newEvaluator   func() Evaluator
 	admissionPolicy bool
 	admissionThres int64
+	sweepInterval  time.Duration
+	sweepBudget    int
+	coalescePages  time.Duration
+	onRefreshError func(key string, err error)
+	codec          Codec
+	pageEviction   bool
+	tinyLFU        int
+	evictionPool   int
+	frequencyHalfLife time.Duration
+	memory         bool
+	keyHasher      func(key string) uint32
+	backendQuotas  map[uint64]quota
+	defaultQuota   *quota
 }
 
 // Creates a configuration object with sensible defaults
@@ -30,9 +44,13 @@ func Configure() *Configuration {
 		countPerSampling: 1000,
 		tracking:       false,
 		updateRatio:    0.3,
-		evalAlgorithm:  evalLFU,
+		newEvaluator:   func() Evaluator { return EvalFunc(evalLFU) },
 		admissionPolicy: false,
 		admissionThres: 10240,
+		sweepInterval:  0,
+		sweepBudget:    1000,
+		codec:          GobCodec{},
+		keyHasher:      HashString,
 	}
 }
 
@@ -40,6 +58,17 @@ func Configure() *Configuration {
 // [5000]
 func (c *Configuration) MaxSize(max int64) *Configuration {
 	c.maxSize = max
+	c.memory = false
+	return c
+}
+
+// Bounds the memory held by the cache's entries to about bytes, replacing
+// MaxSize. Each entry then counts for its key, its value's Size() (or length,
+// for strings and byte slices) and the cache's per entry overhead, instead of
+// just its value's Size().
+func (c *Configuration) MaxMemory(bytes int64) *Configuration {
+	c.maxSize = bytes
+	c.memory = true
 	return c
 }
 
@@ -79,22 +108,26 @@ func (c *Configuration) InitBucketSize(size uint32) *Configuration {
 	return c
 }
 
-// The evaluation algorithm
+// The evaluation algorithm, by name. Built in are "lfu", "lru", "hyperbolic",
+// "h1", "h2" and "adaptive" (see Adaptive), others can be added with
+// RegisterEvaluator
 // [LFU]
 func (c *Configuration) EvalAlgorithm(name string) *Configuration {
-	name = strings.ToLower(name)
-	if strings.Compare(name, "lfu") == 0 {
-		c.evalAlgorithm = evalLFU
-	} else if strings.Compare(name, "lru") == 0 {
-		c.evalAlgorithm = evalLRU
-	} else if strings.Compare(name, "hyperbolic") == 0 {
-		c.evalAlgorithm = evalHyperbolic
-	} else if strings.Compare(name, "h1") == 0 {
-		c.evalAlgorithm = evalOursH1
-	} else if strings.Compare(name, "h2") == 0 {
-		c.evalAlgorithm = evalOursH2
-	} else {
-		panic("Unrecognized evaluation algorithm.")
+	factory, ok := lookupEvaluator(name)
+	if ok == false {
+		panic("Unrecognized evaluation algorithm: " + name)
+	}
+	c.newEvaluator = factory
+	return c
+}
+
+// The evaluator used to score eviction candidates. Every cache created from
+// this configuration shares it, register a factory with RegisterEvaluator
+// when the evaluator keeps per cache state
+// [LFU]
+func (c *Configuration) Evaluator(e Evaluator) *Configuration {
+	if e != nil {
+		c.newEvaluator = func() Evaluator { return e }
 	}
 	return c
 }
@@ -115,6 +148,38 @@ func (c *Configuration) AdmissionThres(s int64) *Configuration {
 	return c
 }
 
+// How often the background sweeper looks for expired items to remove. Without
+// the sweeper, expired items stay in the cache until they are evicted, replaced
+// or deleted. 0 disables the sweeper
+// [0]
+func (c *Configuration) SweepInterval(interval time.Duration) *Configuration {
+	if interval >= 0 {
+		c.sweepInterval = interval
+	}
+	return c
+}
+
+// The number of items the sweeper looks at on each pass
+// [1000]
+func (c *Configuration) SweepBudget(count uint32) *Configuration {
+	if count > 0 {
+		c.sweepBudget = int(count)
+	}
+	return c
+}
+
+// Coalesces page loads: a GetPage miss on an object which another caller's
+// GetPage also missed, and is presumably loading, waits up to the given time
+// for that caller's SetPage instead of being reported as a miss. Callers which
+// get a miss but don't load it must call AbandonPage. 0 disables coalescing
+// [0]
+func (c *Configuration) CoalescePages(wait time.Duration) *Configuration {
+	if wait >= 0 {
+		c.coalescePages = wait
+	}
+	return c
+}
+
 // Typically, a cache is agnostic about how cached values are use. This is fine
 // for a typical cache usage, where you fetch an item from the cache, do something
 // (write it out) and nothing else.
@@ -127,8 +192,8 @@ func (c *Configuration) AdmissionThres(s int64) *Configuration {
 // identity map is meant to solve).
 
 // By turning tracking on and using the cache's TrackingGet, the cache
-// won't evict items which you haven't called Release() on. It's a simple reference
-// counter.
+// won't evict items which you haven't called Release() on, nor replace them
+// when their key is set again. It's a simple reference counter.
 func (c *Configuration) Track() *Configuration {
 	c.tracking = true
 	return c
@@ -149,4 +214,108 @@ func (c *Configuration) CountPerSampling(count uint64) *Configuration {
 func (c *Configuration) OnDelete(callback func(item *Item)) *Configuration {
 	c.onDelete = callback
 	return c
-}
\ No newline at end of file
+}
+
+// OnEvict allows setting a callback function to be told about every item
+// which leaves the cache, along with why (see RemovalReason) and, for an item
+// the evictor picked, the score its evaluator gave it. The score is 0 for the
+// other removals, such as deletes, sweeps and the other objects of an evicted
+// page, since they aren't scored. Unlike OnDelete, it's also called for the
+// items removed by Clear, and it's called right away for tracked items.
+func (c *Configuration) OnEvict(callback func(item *Item, reason RemovalReason, score float64)) *Configuration {
+	c.onEvict = callback
+	return c
+}
+
+// OnRefreshError allows setting a callback function to be told about failed
+// background fetches started by FetchStale. The stale item stays in the cache.
+func (c *Configuration) OnRefreshError(callback func(key string, err error)) *Configuration {
+	c.onRefreshError = callback
+	return c
+}
+
+// The codec used by Snapshot and RestoreFrom to encode and decode values
+// [GobCodec{}]
+func (c *Configuration) Codec(codec Codec) *Configuration {
+	c.codec = codec
+	return c
+}
+
+// Evicts pages as a whole: objects set together by SetPage (or
+// SetPageWithMissingSize) remember their page, and evicting one of them
+// evicts the others too, since a page only hits if all its objects do
+// [false]
+func (c *Configuration) PageEviction(enabled bool) *Configuration {
+	c.pageEviction = enabled
+	return c
+}
+
+// Enables the TinyLFU admission filter, sized to track about keys distinct
+// keys. Once the cache is full, a new item only gets in if its key is
+// estimated to be more popular than each of the items which would be evicted
+// for it. Pages are admitted or refused as a whole. 0 disables the filter
+// [0]
+func (c *Configuration) TinyLFU(keys int) *Configuration {
+	if keys >= 0 {
+		c.tinyLFU = keys
+	}
+	return c
+}
+
+// Keeps the size best eviction candidates between evictions, instead of only
+// considering the candidates sampled for each eviction. This gets closer to
+// evicting the actual lowest scored item for the same sampling cost.
+// 0 disables the pool
+// [0]
+func (c *Configuration) EvictionPool(size int) *Configuration {
+	if size >= 0 {
+		c.evictionPool = size
+	}
+	return c
+}
+
+// Halves the access frequencies the lfu, hyperbolic, h1 and h2 evaluators
+// score items with every halfLife, so that items which used to be popular
+// eventually make room for the currently popular ones. 0 never ages them
+// (see Item.Frequency)
+// [0]
+func (c *Configuration) FrequencyHalfLife(halfLife time.Duration) *Configuration {
+	if halfLife >= 0 {
+		c.frequencyHalfLife = halfLife
+	}
+	return c
+}
+
+// The hash Cache and LayeredCache use to pick the bucket of a key. Keys of
+// GetPage and SetPage requests always hash their backend and uri instead.
+// [HashString]
+func (c *Configuration) KeyHasher(hasher func(key string) uint32) *Configuration {
+	if hasher != nil {
+		c.keyHasher = hasher
+	}
+	return c
+}
+
+// Bounds the total size of the objects of backend set by SetPage and its
+// variants. Once the backend holds more than max, its own objects are
+// evicted to make room (0 for no cap). Its objects aren't evicted for space
+// while it holds less than min. With any quota configured, evictions for
+// space also prefer the objects of backends over their fair share: an equal
+// part of the max size for every backend with objects, bounded by their min
+// and max.
+func (c *Configuration) BackendQuota(backend uint64, min, max int64) *Configuration {
+	if c.backendQuotas == nil {
+		c.backendQuotas = make(map[uint64]quota)
+	}
+	c.backendQuotas[backend] = quota{min: min, max: max}
+	return c
+}
+
+// The quota of the backends without a BackendQuota of their own.
+// DefaultBackendQuota(0, 0) enables fair sharing without bounding any
+// backend.
+// [none]
+func (c *Configuration) DefaultBackendQuota(min, max int64) *Configuration {
+	c.defaultQuota = &quota{min: min, max: max}
+	return c
+}
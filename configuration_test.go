@@ -21,3 +21,18 @@ func (_ *ConfigurationTests) BucketsPowerOf2() {
 		}
 	}
 }
+
+func (_ *ConfigurationTests) EvalAlgorithmIsCaseInsensitive() {
+	for _, name := range []string{"lfu", "LRU", "Hyperbolic", "h1", "H2"} {
+		c := Configure().EvalAlgorithm(name)
+		Expect(c.newEvaluator()).Not.To.Equal(nil)
+	}
+}
+
+func (_ *ConfigurationTests) EvalAlgorithmUsesRegisteredEvaluators() {
+	RegisterEvaluator("Biggest", func() Evaluator {
+		return EvalFunc(func(item *Item) float64 { return -float64(item.Size()) })
+	})
+	c := Configure().EvalAlgorithm("biggest")
+	Expect(c.newEvaluator().Eval(&Item{size: 4})).To.Equal(float64(-4))
+}
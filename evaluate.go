@@ -1,26 +1,86 @@
 package ccache
 
-import "time"
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// An Evaluator scores eviction candidates. Out of the sampled candidates, the
+// one with the lowest score is evicted.
+type Evaluator interface {
+	Eval(item *Item) float64
+}
+
+// Evaluators which maintain their own state can also implement Observer to be
+// told about every hit, every insertion and every eviction.
+type Observer interface {
+	OnGet(item *Item)
+	OnSet(item *Item)
+	OnEvict(item *Item)
+}
+
+// Evaluators which learn from the evictions, like Adaptive, are also told
+// about the candidates each eviction picked its victim from. The candidates
+// are only valid during the call.
+type roundObserver interface {
+	round(victim *Item, candidates []*Item)
+}
+
+// EvalFunc adapts a plain scoring function to the Evaluator interface
+type EvalFunc func(item *Item) float64
+
+func (f EvalFunc) Eval(item *Item) float64 {
+	return f(item)
+}
+
+var (
+	evaluatorsLock sync.RWMutex
+	evaluators     = map[string]func() Evaluator{
+		"lfu":        func() Evaluator { return EvalFunc(evalLFU) },
+		"lru":        func() Evaluator { return EvalFunc(evalLRU) },
+		"hyperbolic": func() Evaluator { return EvalFunc(evalHyperbolic) },
+		"h1":         func() Evaluator { return EvalFunc(evalOursH1) },
+		"h2":         func() Evaluator { return EvalFunc(evalOursH2) },
+	}
+)
+
+// Registers an evaluator under the given (case insensitive) name so that it
+// can be picked with Configuration.EvalAlgorithm. The factory is called once
+// per cache, letting stateful evaluators keep their state per cache.
+// Registering an existing name replaces it.
+func RegisterEvaluator(name string, factory func() Evaluator) {
+	evaluatorsLock.Lock()
+	defer evaluatorsLock.Unlock()
+	evaluators[strings.ToLower(name)] = factory
+}
+
+func lookupEvaluator(name string) (func() Evaluator, bool) {
+	evaluatorsLock.RLock()
+	defer evaluatorsLock.RUnlock()
+	factory, ok := evaluators[strings.ToLower(name)]
+	return factory, ok
+}
 
 func evalLFU(i *Item) float64 {
-	return float64(i.accCount)
+	return float64(i.Frequency())
 }
 
 func evalLRU(i *Item) float64 {
-	return float64(i.accessTs.Unix())
+	return float64(atomic.LoadInt64(&i.accessed))
 }
 
 func evalHyperbolic(i *Item) float64 {
-	t := time.Now().Sub(i.createTS)
-	return float64(i.accCount) / float64(t) / float64(i.size)
+	t := monotonicNow() - i.created
+	return float64(i.Frequency()) / float64(t) / float64(i.size)
 }
 
 func evalOursH1(i *Item) float64 {
-	t := time.Now().Sub(i.createTS)
-	return float64(i.accCount) / float64(t) / i.reqInfo.ReqSize
+	t := monotonicNow() - i.created
+	return float64(i.Frequency()) / float64(t) / i.reqInfo.ReqSize
 }
 
 func evalOursH2(i *Item) float64 {
-	t := time.Now().Sub(i.createTS)
-	return float64(i.accCount) / float64(t) / i.reqInfo.MissingSize
-}
\ No newline at end of file
+	t := monotonicNow() - i.created
+	return float64(i.Frequency()) / float64(t) / i.reqInfo.MissingSize
+}
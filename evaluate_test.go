@@ -0,0 +1,67 @@
+package ccache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type EvaluateTests struct{}
+
+func Test_Evaluate(t *testing.T) {
+	Expectify(new(EvaluateTests), t)
+}
+
+type countingEvaluator struct {
+	gets, sets, evictions int
+}
+
+func (e *countingEvaluator) Eval(item *Item) float64 {
+	return float64(item.AccessCount())
+}
+
+func (e *countingEvaluator) OnGet(item *Item)   { e.gets++ }
+func (e *countingEvaluator) OnSet(item *Item)   { e.sets++ }
+func (e *countingEvaluator) OnEvict(item *Item) { e.evictions++ }
+
+func (_ EvaluateTests) ObserverSeesEveryEvent() {
+	e := new(countingEvaluator)
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1).Evaluator(e))
+	for i := 0; i < 5; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	// before anything is evicted, so that "4" is there
+	cache.Get("4")
+	cache.Get("nope")
+	for i := 5; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	Expect(e.sets).To.Equal(10)
+	Expect(e.gets).To.Equal(1)
+	Expect(e.evictions).To.Equal(5)
+}
+
+func (_ EvaluateTests) ObserverSeesSecondaryCacheGets() {
+	e := new(countingEvaluator)
+	cache := Layered(Configure().Evaluator(e))
+	cache.Set("spice", "flow", 1, time.Minute)
+	sc := cache.GetOrCreateSecondaryCache("spice")
+	sc.Get("flow")
+	sc.Get("nope")
+	cache.Get("spice", "flow")
+	Expect(e.gets).To.Equal(2)
+}
+
+func (_ EvaluateTests) FactoryIsCalledPerCache() {
+	created := 0
+	RegisterEvaluator("counted", func() Evaluator {
+		created++
+		return new(countingEvaluator)
+	})
+	config := Configure().EvalAlgorithm("counted")
+	New(config)
+	Layered(config)
+	Expect(created).To.Equal(2)
+}
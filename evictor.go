@@ -0,0 +1,304 @@
+package ccache
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// The number of consecutive sampling rounds which can come back without an
+// evictable item (empty buckets, tracked items) before evict gives up.
+const evictRetries = 3
+
+// evictor holds the eviction state shared by Cache and LayeredCache. It picks
+// candidates through the alias tables with a probability proportional to the
+// number of items held by each bucket. The tables are rebuilt every
+// countPerSampling sets/deletes.
+//
+// The eviction parameters start out as configured and can be changed while
+// the cache is in use.
+type evictor struct {
+	counter   uint64
+	tables    unsafe.Pointer
+	overflow  int32
+	shrinking int32
+	pool      *evictionPool
+	aging     *aging
+	rounds    roundObserver
+	params    evictionParams
+}
+
+// The Configuration's eviction parameters, which are only accessed
+// atomically
+type evictionParams struct {
+	maxSize          int64
+	candidates       int64
+	itemsToPrune     int64
+	countPerSampling uint64
+	buckets          int64
+}
+
+type evictable interface {
+	buildSamplingTables() *samplingTables
+	evictionCandidate(bucket int) (*Item, float64)
+	// The item's current score, and false if it is no longer cached or can't
+	// be evicted
+	rescore(bucket int, item *Item) (float64, bool)
+	// Evicts the item, which was given score by the evaluator
+	evictItem(bucket int, item *Item, score float64)
+}
+
+func newEvictor(config *Configuration) evictor {
+	return evictor{
+		pool:  newEvictionPool(config.evictionPool),
+		aging: newAging(config.frequencyHalfLife),
+		params: evictionParams{
+			maxSize:          config.maxSize,
+			candidates:       int64(config.candidates),
+			itemsToPrune:     int64(config.itemsToPrune),
+			countPerSampling: config.countPerSampling,
+			buckets:          int64(config.buckets),
+		},
+	}
+}
+
+// Returns true if the last eviction couldn't bring the cache back under its
+// max size, which happens when every candidate it found was being tracked.
+func (e *evictor) Overflowing() bool {
+	return atomic.LoadInt32(&e.overflow) == 1
+}
+
+// Changes the number of eviction candidates. Like Configuration.Candidates,
+// it can't be more than the number of buckets.
+func (e *evictor) SetCandidates(count int) {
+	if count >= 0 && int64(count) <= atomic.LoadInt64(&e.params.buckets) {
+		atomic.StoreInt64(&e.params.candidates, int64(count))
+	}
+}
+
+// Changes the number of buckets candidates are sampled from, lowering the
+// number of candidates to it if needed
+func (e *evictor) setBuckets(count int) {
+	atomic.StoreInt64(&e.params.buckets, int64(count))
+	for {
+		candidates := atomic.LoadInt64(&e.params.candidates)
+		if candidates <= int64(count) || atomic.CompareAndSwapInt64(&e.params.candidates, candidates, int64(count)) {
+			return
+		}
+	}
+}
+
+// Changes the number of items to prune when the cache is full
+func (e *evictor) SetItemsToPrune(count uint32) {
+	atomic.StoreInt64(&e.params.itemsToPrune, int64(count))
+}
+
+// Changes the count of sets/deletes before each recreation of the sampling
+// tables
+func (e *evictor) SetCountPerSampling(count uint64) {
+	if count > 0 {
+		atomic.StoreUint64(&e.params.countPerSampling, count)
+	}
+}
+
+// The max size (or max memory) currently enforced
+func (e *evictor) capacity() int64 {
+	return atomic.LoadInt64(&e.params.maxSize)
+}
+
+// Changes the max size. If the cache holds more than that, it is shrunk by
+// a background goroutine, itemsToPrune items at a time, rather than by the
+// next set.
+func (e *evictor) resize(max int64, size *int64, target evictable) {
+	atomic.StoreInt64(&e.params.maxSize, max)
+	if atomic.LoadInt64(size) <= max || !atomic.CompareAndSwapInt32(&e.shrinking, 0, 1) {
+		return
+	}
+	go e.shrink(size, target)
+}
+
+// Implemented by the caches which have quotas of their own to enforce before
+// evicting for space, which shrink enforces too
+type quotaEnforcer interface {
+	enforceQuotas()
+}
+
+func (e *evictor) shrink(size *int64, target evictable) {
+	enforcer, _ := target.(quotaEnforcer)
+	for {
+		for atomic.LoadInt64(size) > e.capacity() {
+			if enforcer != nil {
+				enforcer.enforceQuotas()
+				if atomic.LoadInt64(size) <= e.capacity() {
+					break
+				}
+			}
+			if e.prune(size, target, true) == 0 {
+				// only tracked items left
+				break
+			}
+			runtime.Gosched()
+		}
+		atomic.StoreInt32(&e.shrinking, 0)
+		// the max size may have been lowered again before shrinking was reset
+		if atomic.LoadInt64(size) <= e.capacity() || !atomic.CompareAndSwapInt32(&e.shrinking, 0, 1) {
+			return
+		}
+	}
+}
+
+func (e *evictor) evict(size *int64, target evictable) {
+	if atomic.LoadInt64(size) <= e.capacity() {
+		atomic.StoreInt32(&e.overflow, 0)
+		return
+	}
+	// while shrinking, sets only evict their share and leave the rest to the
+	// background goroutine
+	e.prune(size, target, atomic.LoadInt32(&e.shrinking) == 1)
+}
+
+// Evicts items until the cache is under its max size, and at least
+// itemsToPrune of them. With bounded, evicts at most itemsToPrune items.
+// Returns the number of evicted items.
+func (e *evictor) prune(size *int64, target evictable, bounded bool) int {
+	itemsToPrune := int(atomic.LoadInt64(&e.params.itemsToPrune))
+	if bounded && itemsToPrune == 0 {
+		itemsToPrune = 1
+	}
+	candidates := int(atomic.LoadInt64(&e.params.candidates))
+	tables := e.samplingTables(atomic.LoadUint64(&e.params.countPerSampling), target.buildSamplingTables)
+
+	// the candidates of each eviction, when the evaluator learns from them
+	var round *[]*Item
+	if e.rounds != nil {
+		buf := make([]*Item, 0, candidates)
+		round = &buf
+	}
+
+	evicted, misses := 0, 0
+	for ii := 0; ii < itemsToPrune || (!bounded && atomic.LoadInt64(size) > e.capacity()); ii++ {
+		if round != nil {
+			*round = (*round)[:0]
+		}
+		minBucket, minItem, minScore := e.candidate(tables, candidates, target, round)
+		if minItem == nil {
+			// every sampled bucket was empty or only held tracked items
+			if misses++; misses == evictRetries {
+				break
+			}
+			if misses == 1 {
+				tables = e.rebuildSamplingTables(target.buildSamplingTables)
+			}
+			continue
+		}
+		misses = 0
+		target.evictItem(minBucket, minItem, minScore)
+		if round != nil {
+			e.rounds.round(minItem, *round)
+		}
+		evicted++
+	}
+
+	if atomic.LoadInt64(size) > e.capacity() && atomic.LoadInt32(&e.shrinking) == 0 {
+		atomic.StoreInt32(&e.overflow, 1)
+	} else {
+		atomic.StoreInt32(&e.overflow, 0)
+	}
+	return evicted
+}
+
+// Samples count candidates and returns the one to evict, which, with an
+// eviction pool, can be one sampled in a previous round. Unless round is nil,
+// the candidates it was picked from are appended to it.
+func (e *evictor) candidate(tables *samplingTables, count int, target evictable, round *[]*Item) (int, *Item, float64) {
+	if e.pool == nil {
+		return tables.candidate(count, target, round)
+	}
+	e.pool.fill(tables, count, target)
+	return e.pool.take(target, round)
+}
+
+// Returns the items prune would evict to make room for incoming more: at
+// least itemsToPrune of them, and enough that evicting them brings size back
+// under the max size. They are sampled like prune samples them, without being
+// evicted, so they can only approximate the actual victims.
+func (e *evictor) victims(size *int64, incoming int64, target evictable) []*Item {
+	itemsToPrune := int(atomic.LoadInt64(&e.params.itemsToPrune))
+	if itemsToPrune == 0 {
+		itemsToPrune = 1
+	}
+	excess := atomic.LoadInt64(size) + incoming - e.capacity()
+	candidates := int(atomic.LoadInt64(&e.params.candidates))
+	tables := e.samplingTables(atomic.LoadUint64(&e.params.countPerSampling), target.buildSamplingTables)
+
+	var victims []*Item
+	seen := make(map[*Item]struct{})
+	add := func(item *Item) bool {
+		if _, ok := seen[item]; ok {
+			return false
+		}
+		seen[item] = struct{}{}
+		victims = append(victims, item)
+		excess -= item.size
+		return true
+	}
+	if e.pool != nil {
+		// the pool's entries are evicted first
+		e.pool.fill(tables, candidates, target)
+		for _, item := range e.pool.items(target) {
+			if len(victims) >= itemsToPrune && excess <= 0 {
+				return victims
+			}
+			add(item)
+		}
+	}
+	// sampling keeps returning the same candidates once the cache holds few
+	// of them, which prune would have evicted by then
+	for misses := 0; (len(victims) < itemsToPrune || excess > 0) && misses < evictRetries; {
+		if _, item, _ := tables.candidate(candidates, target, nil); item == nil || !add(item) {
+			misses++
+		} else {
+			misses = 0
+		}
+	}
+	return victims
+}
+
+// Returns the sampling tables, rebuilding them with build() if they don't
+// exist yet or if countPerSampling operations happened since the last build.
+// Tables built over few items are rebuilt sooner, once there were as many
+// operations as half their items: by then, sets may have filled buckets the
+// tables barely cover, or don't cover at all, which would never be sampled.
+func (e *evictor) samplingTables(countPerSampling uint64, build func() *samplingTables) *samplingTables {
+	tables := atomic.LoadPointer(&e.tables)
+	if tables == nil {
+		tables = unsafe.Pointer(build())
+		if !atomic.CompareAndSwapPointer(&e.tables, nil, tables) {
+			tables = atomic.LoadPointer(&e.tables)
+		}
+		return (*samplingTables)(tables)
+	}
+	if churn := uint64((*samplingTables)(tables).items/2 + 1); churn < countPerSampling {
+		countPerSampling = churn
+	}
+	if cnt := atomic.LoadUint64(&e.counter); cnt >= countPerSampling {
+		for !atomic.CompareAndSwapUint64(&e.counter, cnt, 0) {
+			cnt = atomic.LoadUint64(&e.counter)
+			if cnt < countPerSampling {
+				return (*samplingTables)(atomic.LoadPointer(&e.tables))
+			}
+		}
+		tables = unsafe.Pointer(build())
+		atomic.StorePointer(&e.tables, tables)
+	}
+	return (*samplingTables)(tables)
+}
+
+// Unconditionally rebuilds the sampling tables. Used when the sampled buckets
+// turned out to be empty or to only hold tracked items.
+func (e *evictor) rebuildSamplingTables(build func() *samplingTables) *samplingTables {
+	tables := build()
+	atomic.StorePointer(&e.tables, unsafe.Pointer(tables))
+	atomic.StoreUint64(&e.counter, 0)
+	return tables
+}
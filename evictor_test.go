@@ -0,0 +1,119 @@
+package ccache
+
+import (
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type EvictorTests struct{}
+
+func Test_Evictor(t *testing.T) {
+	Expectify(new(EvictorTests), t)
+}
+
+func (_ EvictorTests) ShrinksInTheBackground() {
+	cache := New(Configure().MaxSize(1000).ItemsToPrune(10))
+	for i := 0; i < 1000; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SetMaxSize(100)
+	waitForShrink(&cache.evictor)
+	checkSize(cache, 100)
+	Expect(cache.Overflowing()).To.Equal(false)
+}
+
+func (_ EvictorTests) SetsOnlyEvictTheirShareWhileShrinking() {
+	cache := New(Configure().MaxSize(100).ItemsToPrune(5))
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	// as if a background shrink was under way
+	atomic.StoreInt32(&cache.shrinking, 1)
+	atomic.StoreInt64(&cache.params.maxSize, 10)
+	cache.Set("spice", "flow", time.Minute)
+	checkSize(cache, 96)
+	Expect(cache.Overflowing()).To.Equal(false)
+}
+
+func (_ EvictorTests) GrowingKeepsItems() {
+	cache := New(Configure().MaxSize(100).ItemsToPrune(10))
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SetMaxSize(200)
+	for i := 100; i < 200; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	checkSize(cache, 200)
+}
+
+func (_ EvictorTests) ShrinksEvenWithoutItemsToPrune() {
+	cache := Layered(Configure().MaxSize(50).ItemsToPrune(0))
+	for i := 0; i < 50; i++ {
+		cache.Set("spice", strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SetMaxSize(20)
+	waitForShrink(&cache.evictor)
+	checkLayeredSize(cache, 20)
+}
+
+func (_ EvictorTests) ValidatesParameters() {
+	cache := New(Configure().Buckets(8))
+	cache.SetCandidates(4)
+	cache.SetCandidates(9)
+	Expect(cache.params.candidates).To.Equal(int64(4))
+	cache.SetItemsToPrune(7)
+	Expect(cache.params.itemsToPrune).To.Equal(int64(7))
+	cache.SetCountPerSampling(10)
+	cache.SetCountPerSampling(0)
+	Expect(cache.params.countPerSampling).To.Equal(uint64(10))
+}
+
+func (_ EvictorTests) ResizesWhileInUse() {
+	cache := New(Configure().MaxSize(100).ItemsToPrune(5))
+	stress(func(r *rand.Rand) {
+		n := r.Intn(200)
+		switch r.Intn(10) {
+		case 0:
+			cache.SetMaxSize(int64(20 + r.Intn(100)))
+		case 1:
+			cache.SetCandidates(1 + r.Intn(16))
+			cache.SetItemsToPrune(uint32(r.Intn(10)))
+			cache.SetCountPerSampling(uint64(1 + r.Intn(100)))
+		case 2, 3, 4, 5:
+			cache.Set(strconv.Itoa(n), n, time.Minute)
+		default:
+			cache.Get(strconv.Itoa(n))
+		}
+	})
+	cache.SetMaxSize(20)
+	waitForShrink(&cache.evictor)
+	cache.Stop()
+	Expect(cache.size <= 20).To.Equal(true)
+}
+
+func (_ EvictorTests) RebuildsTablesOverFewItemsSooner() {
+	cache := New(Configure())
+	for i := 0; i < 4; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	tables := cache.samplingTables(1000, cache.buildSamplingTables)
+	Expect(tables.items).To.Equal(4)
+	atomic.StoreUint64(&cache.counter, 2)
+	Expect(cache.samplingTables(1000, cache.buildSamplingTables)).To.Equal(tables)
+	cache.Set("spice", "flow", time.Minute)
+	rebuilt := cache.samplingTables(1000, cache.buildSamplingTables)
+	Expect(rebuilt == tables).To.Equal(false)
+	Expect(rebuilt.items).To.Equal(5)
+}
+
+func waitForShrink(e *evictor) {
+	for i := 0; i < 1000 && atomic.LoadInt32(&e.shrinking) == 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,86 @@
+package ccache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A load in progress for a key. Once done is closed, item and value hold the
+// result; both are nil if the load was abandoned or failed.
+type flight struct {
+	done  chan struct{}
+	item  *Item
+	value interface{}
+	err   error
+}
+
+// Coalesces concurrent loads of the same key, so that only one loader runs
+// while the others wait for its result
+type flights struct {
+	sync.Mutex
+	pending int32
+	calls   map[string]*flight
+}
+
+// Returns the flight for the key, and true if the caller started it and is
+// thus responsible for completing it
+func (f *flights) claim(key string) (*flight, bool) {
+	f.Lock()
+	defer f.Unlock()
+	if fl, ok := f.calls[key]; ok {
+		return fl, false
+	}
+	if f.calls == nil {
+		f.calls = make(map[string]*flight)
+	}
+	fl := &flight{done: make(chan struct{})}
+	f.calls[key] = fl
+	atomic.AddInt32(&f.pending, 1)
+	return fl, true
+}
+
+// Completes the key's flight, if any, handing the result to its waiters
+func (f *flights) complete(key string, item *Item, value interface{}, err error) {
+	if atomic.LoadInt32(&f.pending) == 0 {
+		return
+	}
+	f.Lock()
+	fl, ok := f.calls[key]
+	if ok {
+		delete(f.calls, key)
+		atomic.AddInt32(&f.pending, -1)
+	}
+	f.Unlock()
+	if ok {
+		fl.item, fl.value, fl.err = item, value, err
+		close(fl.done)
+	}
+}
+
+// Gives up on a flight which hasn't completed in time, so that the next
+// caller can start a new one
+func (f *flights) abandon(key string, fl *flight) {
+	f.Lock()
+	current, ok := f.calls[key]
+	if ok && current == fl {
+		delete(f.calls, key)
+		atomic.AddInt32(&f.pending, -1)
+	}
+	f.Unlock()
+	if ok && current == fl {
+		close(fl.done)
+	}
+}
+
+// Waits for the flight, giving up at the deadline
+func (f *flights) wait(key string, fl *flight, deadline time.Time) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-fl.done:
+	case <-timer.C:
+		f.abandon(key, fl)
+		<-fl.done
+	}
+}
@@ -0,0 +1,149 @@
+package ccache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type FlightTests struct{}
+
+func Test_Flight(t *testing.T) {
+	Expectify(new(FlightTests), t)
+}
+
+func (_ FlightTests) FetchLoadsOncePerKey() {
+	cache := New(Configure())
+	loads := int32(0)
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(time.Millisecond * 20)
+		return "flow", nil
+	}
+	items := fetchConcurrently(10, func() (*Item, error) { return cache.Fetch("spice", time.Minute, fetch) })
+	Expect(loads).To.Equal(int32(1))
+	for _, item := range items {
+		Expect(item.Value()).To.Equal("flow")
+	}
+}
+
+func (_ FlightTests) FetchSharesTheError() {
+	cache := New(Configure())
+	loads := int32(0)
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(time.Millisecond * 20)
+		return nil, errors.New("no spice")
+	}
+	errs := int32(0)
+	fetchConcurrently(10, func() (*Item, error) {
+		item, err := cache.Fetch("spice", time.Minute, fetch)
+		if err != nil && item == nil {
+			atomic.AddInt32(&errs, 1)
+		}
+		return item, err
+	})
+	Expect(loads).To.Equal(int32(1))
+	Expect(errs).To.Equal(int32(10))
+	Expect(cache.Get("spice")).To.Equal(nil)
+}
+
+func (_ FlightTests) LayeredFetchLoadsOncePerKey() {
+	cache := Layered(Configure())
+	loads := int32(0)
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(time.Millisecond * 20)
+		return "flow", nil
+	}
+	fetchConcurrently(10, func() (*Item, error) { return cache.Fetch("spice", "a", time.Minute, fetch) })
+	fetchConcurrently(10, func() (*Item, error) { return cache.Fetch("spice", "b", time.Minute, fetch) })
+	Expect(loads).To.Equal(int32(2))
+}
+
+func (_ FlightTests) GetPageWaitsForTheLoadingCaller() {
+	cache := New(Configure().CoalescePages(time.Second))
+	loader := []*Request{{Backend: 1, Uri: 1}, {Backend: 1, Uri: 2}}
+	cache.GetPage(loader)
+
+	waiter := []*Request{{Backend: 1, Uri: 1}}
+	done := make(chan struct{})
+	go func() {
+		cache.GetPage(waiter)
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 10)
+	loader[0].Obj, loader[1].Obj = "a", "b"
+	cache.SetPage(loader, time.Minute)
+	<-done
+	Expect(waiter[0].Obj).To.Equal("a")
+	Expect(cache.Stats().PageHits).To.Equal(uint64(1))
+}
+
+func (_ FlightTests) GetPageStopsWaitingAfterTheDeadline() {
+	cache := New(Configure().CoalescePages(time.Millisecond * 10))
+	cache.GetPage([]*Request{{Backend: 1, Uri: 1}})
+
+	waiter := []*Request{{Backend: 1, Uri: 1}}
+	start := time.Now()
+	cache.GetPage(waiter)
+	Expect(waiter[0].Obj).To.Equal(nil)
+	Expect(time.Since(start) >= time.Millisecond*10).To.Equal(true)
+
+	// the flight was abandoned, the next miss loads it
+	_, leader := cache.flights.claim(buildKey(1, 1))
+	Expect(leader).To.Equal(true)
+}
+
+func (_ FlightTests) AbandonPageReleasesWaiters() {
+	cache := New(Configure().CoalescePages(time.Minute))
+	loader := []*Request{{Backend: 1, Uri: 1}}
+	cache.GetPage(loader)
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		cache.AbandonPage(loader)
+	}()
+	waiter := []*Request{{Backend: 1, Uri: 1}}
+	cache.GetPage(waiter)
+	Expect(waiter[0].Obj).To.Equal(nil)
+}
+
+func (_ FlightTests) RejectedPagesAreHandedToWaiters() {
+	cache := New(Configure().MaxSize(10).AdmissionPolicy(true).AdmissionThres(5).CoalescePages(time.Second))
+	loader := []*Request{{Backend: 1, Uri: 1}}
+	cache.GetPage(loader)
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		loader[0].Obj = &SizedItem{1, 20}
+		cache.SetPageWithMissingSize(loader, 20, time.Minute)
+	}()
+	waiter := []*Request{{Backend: 1, Uri: 1}}
+	cache.GetPage(waiter)
+	Expect(waiter[0].Obj.(*SizedItem).id).To.Equal(1)
+	Expect(cache.Get(buildKey(1, 1))).To.Equal(nil)
+}
+
+func (_ FlightTests) PagesDontWaitByDefault() {
+	cache := New(Configure())
+	cache.GetPage([]*Request{{Backend: 1, Uri: 1}})
+	cache.GetPage([]*Request{{Backend: 1, Uri: 1}})
+	Expect(cache.Stats().PageMisses).To.Equal(uint64(2))
+}
+
+func fetchConcurrently(n int, fetch func() (*Item, error)) []*Item {
+	items := make([]*Item, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			items[i], _ = fetch()
+		}(i)
+	}
+	wg.Wait()
+	return items
+}
@@ -1,6 +1,7 @@
 package ccache
 
 import (
+	"fmt"
 	"sync/atomic"
 	"time"
 )
@@ -24,6 +25,10 @@ type ReqInfo struct {
 	MissingSize float64
 }
 
+// Set on refCount once a tracked item has been removed from the cache, the
+// removal callback then runs when the last reference is released.
+const orphaned = int32(1) << 30
+
 type nilItem struct{}
 
 func (n *nilItem) Value() interface{} { return nil }
@@ -48,21 +53,51 @@ var NilTracked = new(nilItem)
 
 type Item struct {
 	idx		   int
+	groupIdx   int
 	key        string
 	group      string
 	promotions int32
 	refCount   int32
 	accCount   int64
+	freq       uint64
 	expires    int64
 	size       int64
 	value      interface{}
 	reqInfo    ReqInfo
-	createTS   time.Time
-	accessTs   time.Time
+	created    int64
+	accessed   int64
+	onRelease  func(item *Item)
+	page       *pageGroup
+	aging      *aging
+	// the key of an item of a TypedCache, whose key is empty
+	typedKey interface{}
+}
+
+// The keys of the objects set together by SetPage, with PageEviction
+type pageGroup struct {
+	keys []string
+}
+
+// Items' access metadata is read by the evaluators while gets update it, so
+// it is only accessed atomically. Creation and access times are kept as
+// nanoseconds on the monotonic clock since epoch to fit in an int64.
+var epoch = time.Now()
+
+func monotonicNow() int64 {
+	return int64(time.Since(epoch))
+}
+
+func fromMonotonic(ts int64) time.Time {
+	return epoch.Add(time.Duration(ts))
+}
+
+func toMonotonic(t time.Time) int64 {
+	return int64(t.Sub(epoch))
 }
 
 func newItem(key string, value interface{}, r *ReqInfo, expires int64) *Item {
 	size := getValueSize(value)
+	now := monotonicNow()
 
 	return &Item{
 		key:        key,
@@ -71,8 +106,8 @@ func newItem(key string, value interface{}, r *ReqInfo, expires int64) *Item {
 		size:       size,
 		expires:    expires,
 		reqInfo:    *r,
-		createTS:   time.Now(),
-		accessTs:   time.Now(),
+		created:    now,
+		accessed:   now,
 	}
 }
 
@@ -106,7 +141,99 @@ func (i *Item) track() {
 }
 
 func (i *Item) Release() {
-	atomic.AddInt32(&i.refCount, -1)
+	if atomic.AddInt32(&i.refCount, -1) == orphaned {
+		if atomic.CompareAndSwapInt32(&i.refCount, orphaned, 0) {
+			i.onRelease(i)
+		}
+	}
+}
+
+// Whether the item is currently referenced through TrackingGet
+func (i *Item) pinned() bool {
+	return atomic.LoadInt32(&i.refCount)&^orphaned > 0
+}
+
+// Defers fn until the last reference to the item is released. Returns false,
+// without calling fn, if the item isn't referenced.
+func (i *Item) orphan(fn func(item *Item)) bool {
+	i.onRelease = fn
+	for {
+		refCount := atomic.LoadInt32(&i.refCount)
+		if refCount <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&i.refCount, refCount, refCount|orphaned) {
+			return true
+		}
+	}
+}
+
+// The item's key. Objects cached by SetPage are keyed "backend:uri", in
+// decimal. The items of a TypedCache have their key formatted with fmt.Sprint,
+// TypedKey returns it as it was set.
+func (i *Item) Key() string {
+	if i.typedKey != nil {
+		return fmt.Sprint(i.typedKey)
+	}
+	return i.key
+}
+
+// The key which identifies the item among those of its cache: its typed key
+// for a TypedCache
+func (i *Item) id() interface{} {
+	if i.typedKey != nil {
+		return i.typedKey
+	}
+	return i.key
+}
+
+// The key of an item of a TypedCache, nil for the items of the other caches
+func (i *Item) TypedKey() interface{} {
+	return i.typedKey
+}
+
+// The size counted against the cache's max size
+func (i *Item) Size() int64 {
+	return i.size
+}
+
+// Records a get of the item
+func (i *Item) access() {
+	atomic.AddInt64(&i.accCount, 1)
+	atomic.StoreInt64(&i.accessed, monotonicNow())
+	if i.aging != nil {
+		i.aging.touch(&i.freq)
+	}
+}
+
+// The number of times the item was fetched from the cache
+func (i *Item) AccessCount() int64 {
+	return atomic.LoadInt64(&i.accCount)
+}
+
+// The access count used by the frequency based evaluators. Without
+// FrequencyHalfLife, it is the AccessCount. Otherwise, it is halved every
+// half-life.
+func (i *Item) Frequency() int64 {
+	if i.aging != nil {
+		return i.aging.frequency(&i.freq)
+	}
+	return atomic.LoadInt64(&i.accCount)
+}
+
+// When the item was put in the cache
+func (i *Item) Created() time.Time {
+	return fromMonotonic(i.created)
+}
+
+// When the item was last fetched from the cache
+func (i *Item) Accessed() time.Time {
+	return fromMonotonic(atomic.LoadInt64(&i.accessed))
+}
+
+// The request (page) information the item was set with
+func (i *Item) ReqInfo() ReqInfo {
+	return i.reqInfo
 }
 
 func (i *Item) Expired() bool {
@@ -1,82 +1,183 @@
 package ccache
-//
-//import (
-//	"sync"
-//	"time"
-//)
-//
-//type layeredBucket struct {
-//	sync.RWMutex
-//	buckets map[string]*bucket
-//}
-//
-//func (b *layeredBucket) get(primary, secondary string) *Item {
-//	bucket := b.getSecondaryBucket(primary)
-//	if bucket == nil {
-//		return nil
-//	}
-//	return bucket.get(secondary)
-//}
-//
-//func (b *layeredBucket) getSecondaryBucket(primary string) *bucket {
-//	b.RLock()
-//	bucket, exists := b.buckets[primary]
-//	b.RUnlock()
-//	if exists == false {
-//		return nil
-//	}
-//	return bucket
-//}
-//
-//func (b *layeredBucket) set(primary, secondary string, value interface{}, duration time.Duration) (*Item, *Item) {
-//	b.Lock()
-//	bkt, exists := b.buckets[primary]
-//	if exists == false {
-//		bkt = &bucket{lookup: make(map[string]*Item), pq: NewPQ()}
-//		b.buckets[primary] = bkt
-//	}
-//	b.Unlock()
-//	item, existing := bkt.set(secondary, value, duration)
-//	item.group = primary
-//	return item, existing
-//}
-//
-//func (b *layeredBucket) delete(primary, secondary string) *Item {
-//	b.RLock()
-//	bucket, exists := b.buckets[primary]
-//	b.RUnlock()
-//	if exists == false {
-//		return nil
-//	}
-//	return bucket.delete(secondary)
-//}
-//
-//func (b *layeredBucket) deleteAll(primary string, deletables chan *Item) bool {
-//	b.RLock()
-//	bucket, exists := b.buckets[primary]
-//	b.RUnlock()
-//	if exists == false {
-//		return false
-//	}
-//
-//	bucket.Lock()
-//	defer bucket.Unlock()
-//
-//	if l := len(bucket.lookup); l == 0 {
-//		return false
-//	}
-//	for key, item := range bucket.lookup {
-//		delete(bucket.lookup, key)
-//		deletables <- item
-//	}
-//	return true
-//}
-//
-//func (b *layeredBucket) clear() {
-//	b.Lock()
-//	defer b.Unlock()
-//	for _, bucket := range b.buckets {
-//		bucket.clear()
-//	}
-//	b.buckets = make(map[string]*bucket)
-//}
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type layeredBucket struct {
+	sync.RWMutex
+	buckets     map[string]*bucket
+	arr         []*Item // every item of every secondary bucket, for sampling
+	init        int
+	updateRatio float64
+	aging       *aging
+	memory      bool
+	tracking    bool
+}
+
+func newLayeredBucket(initSize int, ur float64) *layeredBucket {
+	return &layeredBucket{
+		buckets:     make(map[string]*bucket),
+		arr:         NewArr(initSize),
+		init:        initSize,
+		updateRatio: ur,
+	}
+}
+
+func (b *layeredBucket) get(primary, secondary string) *Item {
+	bucket := b.getSecondaryBucket(primary)
+	if bucket == nil {
+		return nil
+	}
+	return bucket.get(secondary)
+}
+
+// Like get, but doesn't count as an access
+func (b *layeredBucket) peek(primary, secondary string) *Item {
+	bucket := b.getSecondaryBucket(primary)
+	if bucket == nil {
+		return nil
+	}
+	return bucket.peek(secondary)
+}
+
+func (b *layeredBucket) getSecondaryBucket(primary string) *bucket {
+	b.RLock()
+	bucket, exists := b.buckets[primary]
+	b.RUnlock()
+	if exists == false {
+		return nil
+	}
+	return bucket
+}
+
+func (b *layeredBucket) getOrCreateSecondaryBucket(primary string) *bucket {
+	if bkt := b.getSecondaryBucket(primary); bkt != nil {
+		return bkt
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.secondaryBucketInner(primary)
+}
+
+func (b *layeredBucket) secondaryBucketInner(primary string) *bucket {
+	bkt, exists := b.buckets[primary]
+	if exists == false {
+		bkt = NewBucket(0, b.updateRatio)
+		bkt.aging = b.aging
+		bkt.memory = b.memory
+		bkt.tracking = b.tracking
+		b.buckets[primary] = bkt
+	}
+	return bkt
+}
+
+// Sets the item, returning the item it replaced. Like bucket.setItem, a
+// tracked item is left in place, and returned with false.
+func (b *layeredBucket) set(primary, secondary string, value interface{}, r *ReqInfo, duration time.Duration) (*Item, *Item, bool) {
+	b.Lock()
+	defer b.Unlock()
+	item, existing, stored := b.secondaryBucketInner(primary).set(secondary, value, r, duration)
+	item.group = primary
+	if !stored {
+		return item, existing, false
+	}
+	if existing != nil {
+		item.groupIdx = existing.groupIdx
+		b.arr[item.groupIdx] = item
+	} else {
+		b.arr = append(b.arr, item)
+		item.groupIdx = len(b.arr) - 1
+	}
+	return item, existing, true
+}
+
+func (b *layeredBucket) delete(primary, secondary string) (*Item, bool) {
+	b.Lock()
+	defer b.Unlock()
+	bkt, exists := b.buckets[primary]
+	if exists == false {
+		return nil, false
+	}
+	item, ok := bkt.delete(secondary)
+	if ok {
+		b.removeInner(item)
+	}
+	return item, ok
+}
+
+// Removes the item only if it is still the one stored under its keys
+func (b *layeredBucket) deleteItem(item *Item) bool {
+	b.Lock()
+	defer b.Unlock()
+	bkt, exists := b.buckets[item.group]
+	if exists == false || bkt.deleteItem(item) == false {
+		return false
+	}
+	b.removeInner(item)
+	return true
+}
+
+func (b *layeredBucket) deleteAll(primary string) []*Item {
+	b.Lock()
+	defer b.Unlock()
+	bkt, exists := b.buckets[primary]
+	if exists == false {
+		return nil
+	}
+	items := bkt.deleteAll()
+	for _, item := range items {
+		b.removeInner(item)
+	}
+	return items
+}
+
+// Removes the item from the flat sampling array. The caller must hold the lock.
+func (b *layeredBucket) removeInner(item *Item) {
+	last := b.arr[len(b.arr)-1]
+	last.groupIdx, item.groupIdx = item.groupIdx, last.groupIdx
+	b.arr[last.groupIdx] = last
+	b.arr[item.groupIdx] = item
+	b.arr = b.arr[:len(b.arr)-1]
+}
+
+// Whether the item is still stored in the bucket
+func (b *layeredBucket) contains(item *Item) bool {
+	b.RLock()
+	defer b.RUnlock()
+	return item.groupIdx < len(b.arr) && b.arr[item.groupIdx] == item
+}
+
+func (b *layeredBucket) getNum() int {
+	b.RLock()
+	defer b.RUnlock()
+
+	return len(b.arr)
+}
+
+func (b *layeredBucket) getCandidate(e Evaluator) (*Item, float64) {
+	b.RLock()
+	defer b.RUnlock()
+
+	l := len(b.arr)
+	if l == 0 {
+		return nil, 0
+	}
+	item := b.arr[rand.Intn(l)]
+	return item, e.Eval(item)
+}
+
+// Removes every item and returns them
+func (b *layeredBucket) clear() []*Item {
+	b.Lock()
+	defer b.Unlock()
+	for _, bucket := range b.buckets {
+		bucket.clear()
+	}
+	items := b.arr
+	b.buckets = make(map[string]*bucket)
+	b.arr = NewArr(b.init)
+	return items
+}
@@ -1,240 +1,293 @@
 // An LRU cached aimed at high concurrency
 package ccache
-//
-//import (
-//	"container/list"
-//	"hash/fnv"
-//	"sync/atomic"
-//	"time"
-//)
-//
-//type LayeredCache struct {
-//	*Configuration
-//	list        *list.List
-//	buckets     []*layeredBucket
-//	bucketMask  uint32
-//	size        int64
-//	deletables  chan *Item
-//	promotables chan *Item
-//	donec       chan struct{}
-//}
-//
-//// Create a new layered cache with the specified configuration.
-//// A layered cache used a two keys to identify a value: a primary key
-//// and a secondary key. Get, Set and Delete require both a primary and
-//// secondary key. However, DeleteAll requires only a primary key, deleting
-//// all values that share the same primary key.
-//
-//// Layered Cache is useful as an HTTP cache, where an HTTP purge might
-//// delete multiple variants of the same resource:
-//// primary key = "user/44"
-//// secondary key 1 = ".json"
-//// secondary key 2 = ".xml"
-//
-//// See ccache.Configure() for creating a configuration
-//func Layered(config *Configuration) *LayeredCache {
-//	c := &LayeredCache{
-//		list:          list.New(),
-//		Configuration: config,
-//		bucketMask:    uint32(config.buckets) - 1,
-//		buckets:       make([]*layeredBucket, config.buckets),
-//		deletables:    make(chan *Item, config.deleteBuffer),
-//	}
-//	for i := 0; i < int(config.buckets); i++ {
-//		c.buckets[i] = &layeredBucket{
-//			buckets: make(map[string]*bucket),
-//		}
-//	}
-//	c.restart()
-//	return c
-//}
-//
-//// Get an item from the cache. Returns nil if the item wasn't found.
-//// This can return an expired item. Use item.Expired() to see if the item
-//// is expired and item.TTL() to see how long until the item expires (which
-//// will be negative for an already expired item).
-//func (c *LayeredCache) Get(primary, secondary string) *Item {
-//	item := c.bucket(primary).get(primary, secondary)
-//	if item == nil {
-//		return nil
-//	}
-//	if item.expires > time.Now().UnixNano() {
-//		c.promote(item)
-//	}
-//	return item
-//}
-//
-//// Get the secondary cache for a given primary key. This operation will
-//// never return nil. In the case where the primary key does not exist, a
-//// new, underlying, empty bucket will be created and returned.
-//func (c *LayeredCache) GetOrCreateSecondaryCache(primary string) *SecondaryCache {
-//	primaryBkt := c.bucket(primary)
-//	bkt := primaryBkt.getSecondaryBucket(primary)
-//	primaryBkt.Lock()
-//	if bkt == nil {
-//		bkt = &bucket{lookup: make(map[string]*Item), pq: NewPQ()}
-//		primaryBkt.buckets[primary] = bkt
-//	}
-//	primaryBkt.Unlock()
-//	return &SecondaryCache{
-//		bucket: bkt,
-//		pCache: c,
-//	}
-//}
-//
-//// Used when the cache was created with the Track() configuration option.
-//// Avoid otherwise
-//func (c *LayeredCache) TrackingGet(primary, secondary string) TrackedItem {
-//	item := c.Get(primary, secondary)
-//	if item == nil {
-//		return NilTracked
-//	}
-//	item.track()
-//	return item
-//}
-//
-//// Set the value in the cache for the specified duration
-//func (c *LayeredCache) Set(primary, secondary string, value interface{}, duration time.Duration) {
-//	c.set(primary, secondary, value, duration)
-//}
-//
-//// Replace the value if it exists, does not set if it doesn't.
-//// Returns true if the item existed an was replaced, false otherwise.
-//// Replace does not reset item's TTL nor does it alter its position in the LRU
-//func (c *LayeredCache) Replace(primary, secondary string, value interface{}) bool {
-//	item := c.bucket(primary).get(primary, secondary)
-//	if item == nil {
-//		return false
-//	}
-//	c.Set(primary, secondary, value, item.TTL())
-//	return true
-//}
-//
-//// Attempts to get the value from the cache and calles fetch on a miss.
-//// If fetch returns an error, no value is cached and the error is returned back
-//// to the caller.
-//func (c *LayeredCache) Fetch(primary, secondary string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
-//	item := c.Get(primary, secondary)
-//	if item != nil {
-//		return item, nil
-//	}
-//	value, err := fetch()
-//	if err != nil {
-//		return nil, err
-//	}
-//	return c.set(primary, secondary, value, duration), nil
-//}
-//
-//// Remove the item from the cache, return true if the item was present, false otherwise.
-//func (c *LayeredCache) Delete(primary, secondary string) bool {
-//	item := c.bucket(primary).delete(primary, secondary)
-//	if item != nil {
-//		c.deletables <- item
-//		return true
-//	}
-//	return false
-//}
-//
-//// Deletes all items that share the same primary key
-//func (c *LayeredCache) DeleteAll(primary string) bool {
-//	return c.bucket(primary).deleteAll(primary, c.deletables)
-//}
-//
-////this isn't thread safe. It's meant to be called from non-concurrent tests
-//func (c *LayeredCache) Clear() {
-//	for _, bucket := range c.buckets {
-//		bucket.clear()
-//	}
-//	c.size = 0
-//	c.list = list.New()
-//}
-//
-//func (c *LayeredCache) Stop() {
-//	close(c.promotables)
-//	<-c.donec
-//}
-//
-//func (c *LayeredCache) restart() {
-//	c.promotables = make(chan *Item, c.promoteBuffer)
-//	c.donec = make(chan struct{})
-//	go c.worker()
-//}
-//
-//func (c *LayeredCache) set(primary, secondary string, value interface{}, duration time.Duration) *Item {
-//	item, existing := c.bucket(primary).set(primary, secondary, value, duration)
-//	if existing != nil {
-//		c.deletables <- existing
-//	}
-//	c.promote(item)
-//	return item
-//}
-//
-//func (c *LayeredCache) bucket(key string) *layeredBucket {
-//	h := fnv.New32a()
-//	h.Write([]byte(key))
-//	return c.buckets[h.Sum32()&c.bucketMask]
-//}
-//
-//func (c *LayeredCache) promote(item *Item) {
-//	c.promotables <- item
-//}
-//
-//func (c *LayeredCache) worker() {
-//	defer close(c.donec)
-//	for {
-//		select {
-//		case item, ok := <-c.promotables:
-//			if ok == false {
-//				return
-//			}
-//			if c.doPromote(item) && c.size > c.maxSize {
-//				c.gc()
-//			}
-//		case item := <-c.deletables:
-//			if item.element == nil {
-//				item.promotions = -2
-//			} else {
-//				c.size -= item.size
-//				if c.onDelete != nil {
-//					c.onDelete(item)
-//				}
-//				c.list.Remove(item.element)
-//			}
-//		}
-//	}
-//}
-//
-//func (c *LayeredCache) doPromote(item *Item) bool {
-//	// deleted before it ever got promoted
-//	if item.promotions == -2 {
-//		return false
-//	}
-//	if item.element != nil { //not a new item
-//		if item.shouldPromote(c.getsPerPromote) {
-//			c.list.MoveToFront(item.element)
-//			item.promotions = 0
-//		}
-//		return false
-//	}
-//	c.size += item.size
-//	item.element = c.list.PushFront(item)
-//	return true
-//}
-//
-//func (c *LayeredCache) gc() {
-//	element := c.list.Back()
-//	for i := 0; i < c.itemsToPrune; i++ {
-//		if element == nil {
-//			return
-//		}
-//		prev := element.Prev()
-//		item := element.Value.(*Item)
-//		if c.tracking == false || atomic.LoadInt32(&item.refCount) == 0 {
-//			c.bucket(item.group).delete(item.group, item.key)
-//			c.size -= item.size
-//			c.list.Remove(element)
-//			item.promotions = -2
-//		}
-//		element = prev
-//	}
-//}
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type LayeredCache struct {
+	*Configuration
+	evictor
+	size       int64
+	buckets    []*layeredBucket
+	bucketMask uint32
+	eval       Evaluator
+	observer   Observer
+	flights    flights
+}
+
+// Create a new layered cache with the specified configuration.
+// A layered cache used a two keys to identify a value: a primary key
+// and a secondary key. Get, Set and Delete require both a primary and
+// secondary key. However, DeleteAll requires only a primary key, deleting
+// all values that share the same primary key.
+
+// Layered Cache is useful as an HTTP cache, where an HTTP purge might
+// delete multiple variants of the same resource:
+// primary key = "user/44"
+// secondary key 1 = ".json"
+// secondary key 2 = ".xml"
+
+// See ccache.Configure() for creating a configuration
+func Layered(config *Configuration) *LayeredCache {
+	c := &LayeredCache{
+		Configuration: config,
+		evictor:       newEvictor(config),
+		bucketMask:    uint32(config.buckets) - 1,
+		buckets:       make([]*layeredBucket, config.buckets),
+		eval:          config.newEvaluator(),
+	}
+	c.observer, _ = c.eval.(Observer)
+	c.rounds, _ = c.eval.(roundObserver)
+	for i := 0; i < int(config.buckets); i++ {
+		c.buckets[i] = newLayeredBucket(config.initBucketSize, c.updateRatio)
+		c.buckets[i].aging = c.aging
+		c.buckets[i].memory = c.memory
+		c.buckets[i].tracking = c.tracking
+	}
+	return c
+}
+
+// Get an item from the cache. Returns nil if the item wasn't found.
+// This can return an expired item. Use item.Expired() to see if the item
+// is expired and item.TTL() to see how long until the item expires (which
+// will be negative for an already expired item).
+func (c *LayeredCache) Get(primary, secondary string) *Item {
+	return c.observeGet(c.bucket(primary).get(primary, secondary))
+}
+
+// Tells the observer about a get which found item, and returns it
+func (c *LayeredCache) observeGet(item *Item) *Item {
+	if item != nil && c.observer != nil {
+		c.observer.OnGet(item)
+	}
+	return item
+}
+
+// Get the secondary cache for a given primary key. This operation will
+// never return nil. In the case where the primary key does not exist, a
+// new, underlying, empty bucket will be created and returned.
+func (c *LayeredCache) GetOrCreateSecondaryCache(primary string) *SecondaryCache {
+	return &SecondaryCache{
+		bucket:  c.bucket(primary).getOrCreateSecondaryBucket(primary),
+		pCache:  c,
+		primary: primary,
+	}
+}
+
+// Used when the cache was created with the Track() configuration option.
+// Avoid otherwise
+func (c *LayeredCache) TrackingGet(primary, secondary string) TrackedItem {
+	item := c.Get(primary, secondary)
+	if item == nil {
+		return NilTracked
+	}
+	item.track()
+	return item
+}
+
+// Set the value in the cache for the specified duration
+func (c *LayeredCache) Set(primary, secondary string, value interface{}, duration time.Duration) {
+	atomic.AddUint64(&c.counter, 1)
+	c.set(primary, secondary, value, getDefaultReqInfo(value), duration)
+}
+
+// Replace the value if it exists, does not set if it doesn't.
+// Returns true if the item existed an was replaced, false otherwise, which
+// includes a tracked item left in place.
+// Replace does not reset item's TTL
+func (c *LayeredCache) Replace(primary, secondary string, value interface{}) bool {
+	item := c.bucket(primary).get(primary, secondary)
+	if item == nil {
+		return false
+	}
+	atomic.AddUint64(&c.counter, 1)
+	_, replaced := c.set(primary, secondary, value, getDefaultReqInfo(value), item.TTL())
+	return replaced
+}
+
+// Attempts to get the value from the cache and calles fetch on a miss (missing
+// or stale item). If fetch returns an error, no value is cached and the error
+// is returned back to the caller.
+// Concurrent misses on the same keys are coalesced: fetch only runs in one of
+// the callers and the others get its result, or its error.
+func (c *LayeredCache) Fetch(primary, secondary string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
+	item := c.Get(primary, secondary)
+	if item != nil && !item.Expired() {
+		return item, nil
+	}
+	key := primary + "\x00" + secondary
+	fl, leader := c.flights.claim(key)
+	if leader {
+		return c.fetchFlight(key, primary, secondary, duration, fetch)
+	}
+	<-fl.done
+	if fl.err != nil || fl.item != nil {
+		return fl.item, fl.err
+	}
+	// the load panicked, do it ourselves
+	return c.load(primary, secondary, duration, fetch)
+}
+
+// Loads the value and completes the key's flight with the result, even if
+// fetch panics
+func (c *LayeredCache) fetchFlight(key, primary, secondary string, duration time.Duration, fetch func() (interface{}, error)) (item *Item, err error) {
+	defer func() {
+		var value interface{}
+		if item != nil {
+			value = item.value
+		}
+		c.flights.complete(key, item, value, err)
+	}()
+	// the previous flight could have landed between our Get and our claim
+	if existing := c.bucket(primary).peek(primary, secondary); existing != nil && !existing.Expired() {
+		return existing, nil
+	}
+	return c.load(primary, secondary, duration, fetch)
+}
+
+func (c *LayeredCache) load(primary, secondary string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
+	value, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	item, _ := c.set(primary, secondary, value, getDefaultReqInfo(value), duration)
+	return item, nil
+}
+
+// Remove the item from the cache, return true if the item was present, false otherwise.
+func (c *LayeredCache) Delete(primary, secondary string) bool {
+	atomic.AddUint64(&c.counter, 1)
+	item, _ := c.bucket(primary).delete(primary, secondary)
+	if item != nil {
+		c.afterDelete(item, RemovedDeleted, 0)
+		return true
+	}
+	return false
+}
+
+// Deletes all items that share the same primary key
+func (c *LayeredCache) DeleteAll(primary string) bool {
+	items := c.bucket(primary).deleteAll(primary)
+	atomic.AddUint64(&c.counter, uint64(len(items)))
+	for _, item := range items {
+		c.afterDelete(item, RemovedDeleted, 0)
+	}
+	return len(items) > 0
+}
+
+//this isn't thread safe. It's meant to be called from non-concurrent tests
+func (c *LayeredCache) Clear() {
+	for _, bucket := range c.buckets {
+		for _, item := range bucket.clear() {
+			c.evicted(item, RemovedCleared, 0)
+		}
+	}
+	atomic.StoreInt64(&c.size, 0)
+}
+
+// Changes the max size (the max memory, with MaxMemory) of the cache. If the
+// cache holds more than that, it's shrunk in the background, a few items at
+// a time. Candidates, ItemsToPrune and CountPerSampling can be changed
+// likewise with SetCandidates, SetItemsToPrune and SetCountPerSampling.
+func (c *LayeredCache) SetMaxSize(max int64) {
+	c.resize(max, &c.size, c)
+}
+
+// Stops the background worker. Operations performed on the cache after Stop
+// is called are likely to panic
+func (c *LayeredCache) Stop() {
+}
+
+// Sets the item, and returns it along with whether it was cached, which it
+// isn't when it would replace a tracked item
+func (c *LayeredCache) set(primary, secondary string, value interface{}, r *ReqInfo, duration time.Duration) (*Item, bool) {
+	item, existing, stored := c.bucket(primary).set(primary, secondary, value, r, duration)
+	if !stored {
+		return item, false
+	}
+	if existing != nil {
+		c.afterDelete(existing, RemovedReplaced, 0)
+	}
+	c.introduce(item)
+	return item, true
+}
+
+func (c *LayeredCache) bucket(key string) *layeredBucket {
+	return c.buckets[hashKey(key, c.keyHasher)&c.bucketMask]
+}
+
+func (c *LayeredCache) introduce(item *Item) {
+	c.atInsert(item)
+	c.evict()
+}
+
+// score is the evaluator's score of an item it picked for eviction, 0 for
+// every other removal
+func (c *LayeredCache) afterDelete(item *Item, reason RemovalReason, score float64) {
+	atomic.AddInt64(&c.size, -item.size)
+	c.evicted(item, reason, score)
+
+	if c.onDelete != nil {
+		// a tracked item is only cleaned up once it has been released
+		if c.tracking && item.orphan(c.onDelete) {
+			return
+		}
+		c.onDelete(item)
+	}
+}
+
+// Calls OnEvict
+func (c *LayeredCache) evicted(item *Item, reason RemovalReason, score float64) {
+	if c.onEvict != nil {
+		c.onEvict(item, reason, score)
+	}
+}
+
+func (c *LayeredCache) atInsert(item *Item) {
+	atomic.AddInt64(&c.size, item.size)
+	if c.observer != nil {
+		c.observer.OnSet(item)
+	}
+}
+
+func (c *LayeredCache) buildSamplingTables() *samplingTables {
+	nums := make([]int, len(c.buckets))
+	for i, bucket := range c.buckets {
+		nums[i] = bucket.getNum()
+	}
+	return buildSamplingTables(nums)
+}
+
+func (c *LayeredCache) evict() {
+	c.evictor.evict(&c.size, c)
+}
+
+func (c *LayeredCache) evictionCandidate(bucket int) (*Item, float64) {
+	item, val := c.buckets[bucket].getCandidate(c.eval)
+	if item != nil && c.tracking && item.pinned() {
+		return nil, 0
+	}
+	return item, val
+}
+
+func (c *LayeredCache) rescore(bucket int, item *Item) (float64, bool) {
+	if !c.buckets[bucket].contains(item) || (c.tracking && item.pinned()) {
+		return 0, false
+	}
+	return c.eval.Eval(item), true
+}
+
+func (c *LayeredCache) evictItem(bucket int, item *Item, score float64) {
+	if c.buckets[bucket].deleteItem(item) {
+		reason := RemovedEvicted
+		if item.Expired() {
+			reason = RemovedExpired
+		}
+		c.afterDelete(item, reason, score)
+		if c.observer != nil {
+			c.observer.OnEvict(item)
+		}
+	}
+}
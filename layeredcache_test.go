@@ -1,246 +1,265 @@
 package ccache
-//
-//import (
-//	"strconv"
-//	"testing"
-//	"time"
-//
-//	. "github.com/karlseguin/expect"
-//)
-//
-//type LayeredCacheTests struct{}
-//
-//func Test_LayeredCache(t *testing.T) {
-//	Expectify(new(LayeredCacheTests), t)
-//}
-//
-//func (_ *LayeredCacheTests) GetsANonExistantValue() {
-//	cache := newLayered()
-//	Expect(cache.Get("spice", "flow")).To.Equal(nil)
-//}
-//
-//func (_ *LayeredCacheTests) SetANewValue() {
-//	cache := newLayered()
-//	cache.Set("spice", "flow", "a value", time.Minute)
-//	Expect(cache.Get("spice", "flow").Value()).To.Equal("a value")
-//	Expect(cache.Get("spice", "stop")).To.Equal(nil)
-//}
-//
-//func (_ *LayeredCacheTests) SetsMultipleValueWithinTheSameLayer() {
-//	cache := newLayered()
-//	cache.Set("spice", "flow", "value-a", time.Minute)
-//	cache.Set("spice", "must", "value-b", time.Minute)
-//	cache.Set("leto", "sister", "ghanima", time.Minute)
-//	Expect(cache.Get("spice", "flow").Value()).To.Equal("value-a")
-//	Expect(cache.Get("spice", "must").Value()).To.Equal("value-b")
-//	Expect(cache.Get("spice", "worm")).To.Equal(nil)
-//
-//	Expect(cache.Get("leto", "sister").Value()).To.Equal("ghanima")
-//	Expect(cache.Get("leto", "brother")).To.Equal(nil)
-//	Expect(cache.Get("baron", "friend")).To.Equal(nil)
-//}
-//
-//func (_ *LayeredCacheTests) ReplaceDoesNothingIfKeyDoesNotExist() {
-//	cache := newLayered()
-//	Expect(cache.Replace("spice", "flow", "value-a")).To.Equal(false)
-//	Expect(cache.Get("spice", "flow")).To.Equal(nil)
-//}
-//
-//func (_ *LayeredCacheTests) ReplaceUpdatesTheValue() {
-//	cache := newLayered()
-//	cache.Set("spice", "flow", "value-a", time.Minute)
-//	Expect(cache.Replace("spice", "flow", "value-b")).To.Equal(true)
-//	Expect(cache.Get("spice", "flow").Value().(string)).To.Equal("value-b")
-//	//not sure how to test that the TTL hasn't changed sort of a sleep..
-//}
-//
-//func (_ *LayeredCacheTests) DeletesAValue() {
-//	cache := newLayered()
-//	cache.Set("spice", "flow", "value-a", time.Minute)
-//	cache.Set("spice", "must", "value-b", time.Minute)
-//	cache.Set("leto", "sister", "ghanima", time.Minute)
-//	cache.Delete("spice", "flow")
-//	Expect(cache.Get("spice", "flow")).To.Equal(nil)
-//	Expect(cache.Get("spice", "must").Value()).To.Equal("value-b")
-//	Expect(cache.Get("spice", "worm")).To.Equal(nil)
-//	Expect(cache.Get("leto", "sister").Value()).To.Equal("ghanima")
-//}
-//
-//func (_ *LayeredCacheTests) OnDeleteCallbackCalled() {
-//
-//	onDeleteFnCalled := false
-//	onDeleteFn := func(item *Item) {
-//
-//		if item.group == "spice" && item.key == "flow" {
-//			onDeleteFnCalled = true
-//		}
-//	}
-//
-//	cache := Layered(Configure().OnDelete(onDeleteFn))
-//	cache.Set("spice", "flow", "value-a", time.Minute)
-//	cache.Set("spice", "must", "value-b", time.Minute)
-//	cache.Set("leto", "sister", "ghanima", time.Minute)
-//
-//	time.Sleep(time.Millisecond * 10) // Run once to init
-//	cache.Delete("spice", "flow")
-//	time.Sleep(time.Millisecond * 10) // Wait for worker to pick up deleted items
-//
-//	Expect(cache.Get("spice", "flow")).To.Equal(nil)
-//	Expect(cache.Get("spice", "must").Value()).To.Equal("value-b")
-//	Expect(cache.Get("spice", "worm")).To.Equal(nil)
-//	Expect(cache.Get("leto", "sister").Value()).To.Equal("ghanima")
-//
-//	Expect(onDeleteFnCalled).To.Equal(true)
-//}
-//
-//func (_ *LayeredCacheTests) DeletesALayer() {
-//	cache := newLayered()
-//	cache.Set("spice", "flow", "value-a", time.Minute)
-//	cache.Set("spice", "must", "value-b", time.Minute)
-//	cache.Set("leto", "sister", "ghanima", time.Minute)
-//	cache.DeleteAll("spice")
-//	Expect(cache.Get("spice", "flow")).To.Equal(nil)
-//	Expect(cache.Get("spice", "must")).To.Equal(nil)
-//	Expect(cache.Get("spice", "worm")).To.Equal(nil)
-//	Expect(cache.Get("leto", "sister").Value()).To.Equal("ghanima")
-//}
-//
-//func (_ LayeredCacheTests) GCsTheOldestItems() {
-//	cache := Layered(Configure().ItemsToPrune(10))
-//	cache.Set("xx", "a", 23, time.Minute)
-//	for i := 0; i < 500; i++ {
-//		cache.Set(strconv.Itoa(i), "a", i, time.Minute)
-//	}
-//	cache.Set("xx", "b", 9001, time.Minute)
-//	//let the items get promoted (and added to our list)
-//	time.Sleep(time.Millisecond * 10)
-//	gcLayeredCache(cache)
-//	Expect(cache.Get("xx", "a")).To.Equal(nil)
-//	Expect(cache.Get("xx", "b").Value()).To.Equal(9001)
-//	Expect(cache.Get("8", "a")).To.Equal(nil)
-//	Expect(cache.Get("9", "a").Value()).To.Equal(9)
-//	Expect(cache.Get("10", "a").Value()).To.Equal(10)
-//}
-//
-//func (_ LayeredCacheTests) PromotedItemsDontGetPruned() {
-//	cache := Layered(Configure().ItemsToPrune(10).GetsPerPromote(1))
-//	for i := 0; i < 500; i++ {
-//		cache.Set(strconv.Itoa(i), "a", i, time.Minute)
-//	}
-//	time.Sleep(time.Millisecond * 10) //run the worker once to init the list
-//	cache.Get("9", "a")
-//	time.Sleep(time.Millisecond * 10)
-//	gcLayeredCache(cache)
-//	Expect(cache.Get("9", "a").Value()).To.Equal(9)
-//	Expect(cache.Get("10", "a")).To.Equal(nil)
-//	Expect(cache.Get("11", "a").Value()).To.Equal(11)
-//}
-//
-//func (_ LayeredCacheTests) TrackerDoesNotCleanupHeldInstance() {
-//	cache := Layered(Configure().ItemsToPrune(10).Track())
-//	for i := 0; i < 10; i++ {
-//		cache.Set(strconv.Itoa(i), "a", i, time.Minute)
-//	}
-//	item := cache.TrackingGet("0", "a")
-//	time.Sleep(time.Millisecond * 10)
-//	gcLayeredCache(cache)
-//	Expect(cache.Get("0", "a").Value()).To.Equal(0)
-//	Expect(cache.Get("1", "a")).To.Equal(nil)
-//	item.Release()
-//	gcLayeredCache(cache)
-//	Expect(cache.Get("0", "a")).To.Equal(nil)
-//}
-//
-//func (_ LayeredCacheTests) RemovesOldestItemWhenFull() {
-//	cache := Layered(Configure().MaxSize(5).ItemsToPrune(1))
-//	cache.Set("xx", "a", 23, time.Minute)
-//	for i := 0; i < 7; i++ {
-//		cache.Set(strconv.Itoa(i), "a", i, time.Minute)
-//	}
-//	cache.Set("xx", "b", 9001, time.Minute)
-//	time.Sleep(time.Millisecond * 10)
-//	Expect(cache.Get("xx", "a")).To.Equal(nil)
-//	Expect(cache.Get("0", "a")).To.Equal(nil)
-//	Expect(cache.Get("1", "a")).To.Equal(nil)
-//	Expect(cache.Get("2", "a")).To.Equal(nil)
-//	Expect(cache.Get("3", "a").Value()).To.Equal(3)
-//	Expect(cache.Get("xx", "b").Value()).To.Equal(9001)
-//}
-//
-//func newLayered() *LayeredCache {
-//	return Layered(Configure())
-//}
-//
-//func (_ LayeredCacheTests) RemovesOldestItemWhenFullBySizer() {
-//	cache := Layered(Configure().MaxSize(9).ItemsToPrune(2))
-//	for i := 0; i < 7; i++ {
-//		cache.Set("pri", strconv.Itoa(i), &SizedItem{i, 2}, time.Minute)
-//	}
-//	time.Sleep(time.Millisecond * 10)
-//	Expect(cache.Get("pri", "0")).To.Equal(nil)
-//	Expect(cache.Get("pri", "1")).To.Equal(nil)
-//	Expect(cache.Get("pri", "2")).To.Equal(nil)
-//	Expect(cache.Get("pri", "3")).To.Equal(nil)
-//	Expect(cache.Get("pri", "4").Value().(*SizedItem).id).To.Equal(4)
-//}
-//
-//func (_ LayeredCacheTests) SetUpdatesSizeOnDelta() {
-//	cache := Layered(Configure())
-//	cache.Set("pri", "a", &SizedItem{0, 2}, time.Minute)
-//	cache.Set("pri", "b", &SizedItem{0, 3}, time.Minute)
-//	time.Sleep(time.Millisecond * 5)
-//	checkLayeredSize(cache, 5)
-//	cache.Set("pri", "b", &SizedItem{0, 3}, time.Minute)
-//	time.Sleep(time.Millisecond * 5)
-//	checkLayeredSize(cache, 5)
-//	cache.Set("pri", "b", &SizedItem{0, 4}, time.Minute)
-//	time.Sleep(time.Millisecond * 5)
-//	checkLayeredSize(cache, 6)
-//	cache.Set("pri", "b", &SizedItem{0, 2}, time.Minute)
-//	cache.Set("sec", "b", &SizedItem{0, 3}, time.Minute)
-//	time.Sleep(time.Millisecond * 5)
-//	checkLayeredSize(cache, 7)
-//	cache.Delete("pri", "b")
-//	time.Sleep(time.Millisecond * 10)
-//	checkLayeredSize(cache, 5)
-//}
-//
-//func (_ LayeredCacheTests) ReplaceDoesNotchangeSizeIfNotSet() {
-//	cache := Layered(Configure())
-//	cache.Set("pri", "1", &SizedItem{1, 2}, time.Minute)
-//	cache.Set("pri", "2", &SizedItem{1, 2}, time.Minute)
-//	cache.Set("pri", "3", &SizedItem{1, 2}, time.Minute)
-//	cache.Replace("sec", "3", &SizedItem{1, 2})
-//	time.Sleep(time.Millisecond * 5)
-//	checkLayeredSize(cache, 6)
-//}
-//
-//func (_ LayeredCacheTests) ReplaceChangesSize() {
-//	cache := Layered(Configure())
-//	cache.Set("pri", "1", &SizedItem{1, 2}, time.Minute)
-//	cache.Set("pri", "2", &SizedItem{1, 2}, time.Minute)
-//
-//	cache.Replace("pri", "2", &SizedItem{1, 2})
-//	time.Sleep(time.Millisecond * 5)
-//	checkLayeredSize(cache, 4)
-//
-//	cache.Replace("pri", "2", &SizedItem{1, 1})
-//	time.Sleep(time.Millisecond * 5)
-//	checkLayeredSize(cache, 3)
-//
-//	cache.Replace("pri", "2", &SizedItem{1, 3})
-//	time.Sleep(time.Millisecond * 5)
-//	checkLayeredSize(cache, 5)
-//}
-//
-//func checkLayeredSize(cache *LayeredCache, sz int64) {
-//	cache.Stop()
-//	Expect(cache.size).To.Equal(sz)
-//	cache.restart()
-//}
-//
-//func gcLayeredCache(cache *LayeredCache) {
-//	cache.Stop()
-//	cache.gc()
-//	cache.restart()
-//}
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type LayeredCacheTests struct{}
+
+func Test_LayeredCache(t *testing.T) {
+	Expectify(new(LayeredCacheTests), t)
+}
+
+func (_ *LayeredCacheTests) GetsANonExistantValue() {
+	cache := newLayered()
+	Expect(cache.Get("spice", "flow")).To.Equal(nil)
+}
+
+func (_ *LayeredCacheTests) SetANewValue() {
+	cache := newLayered()
+	cache.Set("spice", "flow", "a value", time.Minute)
+	Expect(cache.Get("spice", "flow").Value()).To.Equal("a value")
+	Expect(cache.Get("spice", "stop")).To.Equal(nil)
+}
+
+func (_ *LayeredCacheTests) SetsMultipleValueWithinTheSameLayer() {
+	cache := newLayered()
+	cache.Set("spice", "flow", "value-a", time.Minute)
+	cache.Set("spice", "must", "value-b", time.Minute)
+	cache.Set("leto", "sister", "ghanima", time.Minute)
+	Expect(cache.Get("spice", "flow").Value()).To.Equal("value-a")
+	Expect(cache.Get("spice", "must").Value()).To.Equal("value-b")
+	Expect(cache.Get("spice", "worm")).To.Equal(nil)
+
+	Expect(cache.Get("leto", "sister").Value()).To.Equal("ghanima")
+	Expect(cache.Get("leto", "brother")).To.Equal(nil)
+	Expect(cache.Get("baron", "friend")).To.Equal(nil)
+}
+
+func (_ *LayeredCacheTests) ReplaceDoesNothingIfKeyDoesNotExist() {
+	cache := newLayered()
+	Expect(cache.Replace("spice", "flow", "value-a")).To.Equal(false)
+	Expect(cache.Get("spice", "flow")).To.Equal(nil)
+}
+
+func (_ *LayeredCacheTests) ReplaceUpdatesTheValue() {
+	cache := newLayered()
+	cache.Set("spice", "flow", "value-a", time.Minute)
+	Expect(cache.Replace("spice", "flow", "value-b")).To.Equal(true)
+	Expect(cache.Get("spice", "flow").Value().(string)).To.Equal("value-b")
+	//not sure how to test that the TTL hasn't changed sort of a sleep..
+}
+
+func (_ *LayeredCacheTests) DeletesAValue() {
+	cache := newLayered()
+	cache.Set("spice", "flow", "value-a", time.Minute)
+	cache.Set("spice", "must", "value-b", time.Minute)
+	cache.Set("leto", "sister", "ghanima", time.Minute)
+	cache.Delete("spice", "flow")
+	Expect(cache.Get("spice", "flow")).To.Equal(nil)
+	Expect(cache.Get("spice", "must").Value()).To.Equal("value-b")
+	Expect(cache.Get("spice", "worm")).To.Equal(nil)
+	Expect(cache.Get("leto", "sister").Value()).To.Equal("ghanima")
+}
+
+func (_ *LayeredCacheTests) OnDeleteCallbackCalled() {
+
+	onDeleteFnCalled := false
+	onDeleteFn := func(item *Item) {
+
+		if item.group == "spice" && item.key == "flow" {
+			onDeleteFnCalled = true
+		}
+	}
+
+	cache := Layered(Configure().OnDelete(onDeleteFn))
+	cache.Set("spice", "flow", "value-a", time.Minute)
+	cache.Set("spice", "must", "value-b", time.Minute)
+	cache.Set("leto", "sister", "ghanima", time.Minute)
+
+	cache.Delete("spice", "flow")
+
+	Expect(cache.Get("spice", "flow")).To.Equal(nil)
+	Expect(cache.Get("spice", "must").Value()).To.Equal("value-b")
+	Expect(cache.Get("spice", "worm")).To.Equal(nil)
+	Expect(cache.Get("leto", "sister").Value()).To.Equal("ghanima")
+
+	Expect(onDeleteFnCalled).To.Equal(true)
+}
+
+func (_ *LayeredCacheTests) DeletesALayer() {
+	cache := newLayered()
+	cache.Set("spice", "flow", "value-a", time.Minute)
+	cache.Set("spice", "must", "value-b", time.Minute)
+	cache.Set("leto", "sister", "ghanima", time.Minute)
+	Expect(cache.DeleteAll("spice")).To.Equal(true)
+	Expect(cache.Get("spice", "flow")).To.Equal(nil)
+	Expect(cache.Get("spice", "must")).To.Equal(nil)
+	Expect(cache.Get("spice", "worm")).To.Equal(nil)
+	Expect(cache.Get("leto", "sister").Value()).To.Equal("ghanima")
+	Expect(cache.DeleteAll("spice")).To.Equal(false)
+	checkLayeredSize(cache, 1)
+}
+
+func (_ LayeredCacheTests) OnEvictReportsEveryRemoval() {
+	removed := recordRemovals()
+	cache := Layered(removed.configure(Configure().MaxSize(10).ItemsToPrune(1)))
+	cache.Set("spice", "a", "flow", time.Minute)
+	cache.Set("spice", "a", "must", time.Minute)
+	cache.Set("spice", "b", "sand", time.Minute)
+	cache.Delete("spice", "b")
+	cache.Set("leto", "a", "worm", time.Minute)
+	cache.DeleteAll("leto")
+	cache.Set("dead", "a", "melange", -time.Minute)
+	item := cache.Get("dead", "a")
+	cache.evictItem(int(HashString("dead")&cache.bucketMask), item, 0)
+	Expect(removed.reasons).To.Equal(map[interface{}]RemovalReason{
+		"flow": RemovedReplaced, "sand": RemovedDeleted, "worm": RemovedDeleted, "melange": RemovedExpired,
+	})
+
+	cache.Set("big", "a", &SizedItem{1, 10}, time.Minute)
+	Expect(len(removed.reasons)).To.Equal(5)
+	cache.Clear()
+	Expect(len(removed.reasons)).To.Equal(6)
+}
+
+func (_ LayeredCacheTests) RemovesItemsWhenFull() {
+	cache := Layered(Configure().MaxSize(5).ItemsToPrune(1))
+	cache.Set("xx", "a", 23, time.Minute)
+	for i := 0; i < 7; i++ {
+		cache.Set(strconv.Itoa(i), "a", i, time.Minute)
+	}
+	cache.Set("xx", "b", 9001, time.Minute)
+	checkLayeredSize(cache, 5)
+	Expect(countLayered(cache)).To.Equal(5)
+}
+
+func (_ LayeredCacheTests) KeepsFrequentlyUsedItems() {
+	cache := Layered(Configure().MaxSize(10).ItemsToPrune(1).Candidates(16))
+	for i := 0; i < 10; i++ {
+		cache.Set("pri", strconv.Itoa(i), i, time.Minute)
+	}
+	for i := 0; i < 10; i++ {
+		cache.Get("pri", "0")
+	}
+	for i := 10; i < 20; i++ {
+		cache.Set("sec", strconv.Itoa(i), i, time.Minute)
+	}
+	checkLayeredSize(cache, 10)
+	Expect(cache.Get("pri", "0").Value()).To.Equal(0)
+}
+
+func (_ LayeredCacheTests) TrackerDoesNotCleanupHeldInstance() {
+	cache := Layered(Configure().MaxSize(5).ItemsToPrune(1).Track())
+	cache.Set("0", "a", 0, time.Minute)
+	item := cache.TrackingGet("0", "a")
+	for i := 1; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), "a", i, time.Minute)
+	}
+	checkLayeredSize(cache, 5)
+	Expect(cache.Get("0", "a").Value()).To.Equal(0)
+	item.Release()
+
+	cache.params.maxSize = 0
+	cache.evict()
+	Expect(cache.Overflowing()).To.Equal(false)
+	Expect(cache.Get("0", "a")).To.Equal(nil)
+}
+
+func (_ LayeredCacheTests) SetsLeaveTrackedItemsInPlace() {
+	cache := Layered(Configure().Track())
+	cache.Set("spice", "flow", "a", time.Minute)
+	item := cache.TrackingGet("spice", "flow")
+	cache.Set("spice", "flow", "b", time.Minute)
+	Expect(cache.Replace("spice", "flow", "c")).To.Equal(false)
+	Expect(cache.GetOrCreateSecondaryCache("spice").Replace("flow", "c")).To.Equal(false)
+	Expect(cache.Get("spice", "flow")).To.Equal(item)
+
+	item.Release()
+	Expect(cache.Replace("spice", "flow", "c")).To.Equal(true)
+	Expect(cache.Get("spice", "flow").Value()).To.Equal("c")
+	checkLayeredSize(cache, 1)
+}
+
+func (_ LayeredCacheTests) FetchRecheckDoesntCountAnAccess() {
+	cache := newLayered()
+	cache.Set("spice", "flow", "must", time.Minute)
+	item := cache.Get("spice", "flow")
+	count := item.AccessCount()
+	// a leader finding the item set by the previous flight
+	fetched, err := cache.fetchFlight("spice\x00flow", "spice", "flow", time.Minute, func() (interface{}, error) {
+		return "again", nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(fetched).To.Equal(item)
+	Expect(item.AccessCount()).To.Equal(count)
+}
+
+func newLayered() *LayeredCache {
+	return Layered(Configure())
+}
+
+func (_ LayeredCacheTests) RemovesItemsWhenFullBySizer() {
+	cache := Layered(Configure().MaxSize(9).ItemsToPrune(2))
+	for i := 0; i < 7; i++ {
+		cache.Set("pri", strconv.Itoa(i), &SizedItem{i, 2}, time.Minute)
+	}
+	checkLayeredSize(cache, 6)
+	Expect(countLayered(cache)).To.Equal(3)
+}
+
+func (_ LayeredCacheTests) SetUpdatesSizeOnDelta() {
+	cache := Layered(Configure())
+	cache.Set("pri", "a", &SizedItem{0, 2}, time.Minute)
+	cache.Set("pri", "b", &SizedItem{0, 3}, time.Minute)
+	checkLayeredSize(cache, 5)
+	cache.Set("pri", "b", &SizedItem{0, 3}, time.Minute)
+	checkLayeredSize(cache, 5)
+	cache.Set("pri", "b", &SizedItem{0, 4}, time.Minute)
+	checkLayeredSize(cache, 6)
+	cache.Set("pri", "b", &SizedItem{0, 2}, time.Minute)
+	cache.Set("sec", "b", &SizedItem{0, 3}, time.Minute)
+	checkLayeredSize(cache, 7)
+	cache.Delete("pri", "b")
+	checkLayeredSize(cache, 5)
+}
+
+func (_ LayeredCacheTests) ReplaceDoesNotchangeSizeIfNotSet() {
+	cache := Layered(Configure())
+	cache.Set("pri", "1", &SizedItem{1, 2}, time.Minute)
+	cache.Set("pri", "2", &SizedItem{1, 2}, time.Minute)
+	cache.Set("pri", "3", &SizedItem{1, 2}, time.Minute)
+	cache.Replace("sec", "3", &SizedItem{1, 2})
+	checkLayeredSize(cache, 6)
+}
+
+func (_ LayeredCacheTests) ReplaceChangesSize() {
+	cache := Layered(Configure())
+	cache.Set("pri", "1", &SizedItem{1, 2}, time.Minute)
+	cache.Set("pri", "2", &SizedItem{1, 2}, time.Minute)
+
+	cache.Replace("pri", "2", &SizedItem{1, 2})
+	checkLayeredSize(cache, 4)
+
+	cache.Replace("pri", "2", &SizedItem{1, 1})
+	checkLayeredSize(cache, 3)
+
+	cache.Replace("pri", "2", &SizedItem{1, 3})
+	checkLayeredSize(cache, 5)
+}
+
+func checkLayeredSize(cache *LayeredCache, sz int64) {
+	Expect(cache.size).To.Equal(sz)
+}
+
+func countLayered(cache *LayeredCache) int {
+	count := 0
+	for _, bucket := range cache.buckets {
+		count += bucket.getNum()
+	}
+	return count
+}
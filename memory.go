@@ -0,0 +1,69 @@
+package ccache
+
+import "unsafe"
+
+// With MaxMemory, an item's size is an estimate of the memory its entry
+// holds on to, rather than the value's Size(): the Item itself, its slot in
+// the bucket's array, its entry in the bucket's lookup map, its key and its
+// value.
+var entryOverhead = itemOverhead + lookupEntrySize(int64(unsafe.Sizeof("")))
+
+// The Item and its slot in the bucket's array. Both the arrays and the
+// lookup maps double in size as they grow, so on average they're about two
+// thirds full.
+var itemOverhead = allocSize(int64(unsafe.Sizeof(Item{}))) +
+	int64(unsafe.Sizeof((*Item)(nil)))*3/2
+
+// The memory taken by a lookup map entry whose key takes keySize bytes. The
+// value is an int, and each entry has a control byte.
+func lookupEntrySize(keySize int64) int64 {
+	return (keySize + int64(unsafe.Sizeof(0)) + 1) * 3 / 2
+}
+
+// The estimated memory taken by an entry of key and value. Page entries are
+// also in their bucket's backend index.
+func entryMemory(key string, value interface{}) int64 {
+	size := entryOverhead + allocSize(int64(len(key))) + valueMemory(value)
+	if _, _, ok := splitKey(key); ok {
+		size += backendIndexEntrySize
+	}
+	return size
+}
+
+// The memory taken by a uri in a backend index
+var backendIndexEntrySize = int64(unsafe.Sizeof(uint64(0))+1) * 3 / 2
+
+// The estimated memory taken by an entry of a TypedCache. The key is stored
+// in both the bucket's keys and its lookup map, and boxed in the item.
+func typedEntryMemory(key interface{}, keySize int64, value interface{}) int64 {
+	size := itemOverhead + keySize*3/2 + lookupEntrySize(keySize) + allocSize(keySize) + valueMemory(value)
+	if s, ok := key.(string); ok {
+		size += allocSize(int64(len(s)))
+	}
+	return size
+}
+
+// The memory held by the value. Values which don't implement Sized are only
+// measured if they're strings or byte slices, whose headers are also
+// allocated when they're stored in an interface.
+func valueMemory(value interface{}) int64 {
+	switch v := value.(type) {
+	case Sized:
+		return v.Size()
+	case string:
+		return int64(unsafe.Sizeof(v)) + allocSize(int64(len(v)))
+	case []byte:
+		return int64(unsafe.Sizeof(v)) + allocSize(int64(cap(v)))
+	}
+	return 0
+}
+
+// n rounded up the way the allocator's size classes, which are at most an
+// eighth apart, roughly round it
+func allocSize(n int64) int64 {
+	step := int64(16)
+	for step*8 < n {
+		step *= 2
+	}
+	return (n + step - 1) / step * step
+}
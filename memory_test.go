@@ -0,0 +1,80 @@
+package ccache
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type MemoryTests struct{}
+
+func Test_Memory(t *testing.T) {
+	Expectify(new(MemoryTests), t)
+}
+
+func (_ MemoryTests) CountsEntriesForTheirMemory() {
+	cache := New(Configure().MaxMemory(1 << 20))
+	item, _ := cache.set("spice", "flow", getDefaultReqInfo("flow"), time.Minute)
+	// the key, the string header and the string's bytes
+	Expect(item.Size()).To.Equal(entryOverhead + 16 + 16 + 16)
+	item, _ = cache.set("worm", &SizedItem{0, 100}, getDefaultReqInfo(nil), time.Minute)
+	Expect(item.Size()).To.Equal(entryOverhead + 16 + 100)
+	Expect(cache.size).To.Equal(2*entryOverhead + 164)
+}
+
+func (_ MemoryTests) MaxSizeCountsValuesOnly() {
+	cache := New(Configure().MaxMemory(1 << 20).MaxSize(10))
+	item, _ := cache.set("spice", "flow", getDefaultReqInfo("flow"), time.Minute)
+	Expect(item.Size()).To.Equal(int64(1))
+}
+
+func (_ MemoryTests) SizesLayeredAndPageEntries() {
+	layered := Layered(Configure().MaxMemory(1 << 20))
+	item, _ := layered.set("spice", "flow", "must", getDefaultReqInfo("must"), time.Minute)
+	Expect(item.Size()).To.Equal(entryOverhead + 16 + 16 + 16)
+
+	cache := New(Configure().MaxMemory(1 << 20))
+	cache.SetPage([]*Request{{Backend: 1, Uri: 2, Obj: "flow"}}, time.Minute)
+	key := buildKey(1, 2)
+	Expect(cache.Get(key).Size()).To.Equal(entryOverhead + backendIndexEntrySize + allocSize(int64(len(key))) + 16 + 16)
+}
+
+func (_ MemoryTests) RoundsToSizeClasses() {
+	Expect(allocSize(0)).To.Equal(int64(0))
+	Expect(allocSize(5)).To.Equal(int64(16))
+	Expect(allocSize(100)).To.Equal(int64(112))
+	Expect(allocSize(184)).To.Equal(int64(192))
+	Expect(allocSize(1000)).To.Equal(int64(1024))
+}
+
+// The heap taken by a full cache is within 20% of its MaxMemory
+func (_ MemoryTests) BoundsHeapUsage() {
+	for _, valueSize := range []int{0, 100, 1000} {
+		max := int64(8 << 20)
+		used := heapUsed(func() interface{} {
+			cache := New(Configure().MaxMemory(max).ItemsToPrune(100))
+			for i := 0; i < 100000; i++ {
+				cache.Set("key:"+strconv.Itoa(i), make([]byte, valueSize), time.Minute)
+			}
+			Expect(cache.size <= max).To.Equal(true)
+			return cache
+		})
+		Expect(float64(used) > float64(max)*0.8).To.Equal(true)
+		Expect(float64(used) < float64(max)*1.2).To.Equal(true)
+	}
+}
+
+// The heap retained by what build returns
+func heapUsed(build func() interface{}) int64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	retained := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(retained)
+	return int64(after.HeapAlloc) - int64(before.HeapAlloc)
+}
@@ -0,0 +1,113 @@
+package ccache
+
+import "sync"
+
+// evictionPool keeps the lowest scored candidates across evict rounds, like
+// Redis' eviction pool. Each round adds its freshly sampled candidates to the
+// pool and evicts the pool's lowest scored item, so a good candidate which
+// wasn't the best of its round isn't thrown away. Scores go stale while items
+// wait in the pool, so the item about to be evicted is checked to still be
+// cached and is scored again first.
+type evictionPool struct {
+	sync.Mutex
+	size    int
+	entries []poolEntry // lowest score first
+}
+
+type poolEntry struct {
+	bucket int
+	item   *Item
+	score  float64
+}
+
+func newEvictionPool(size int) *evictionPool {
+	if size <= 0 {
+		return nil
+	}
+	return &evictionPool{
+		size:    size,
+		entries: make([]poolEntry, 0, size+1),
+	}
+}
+
+// Samples count candidates into the pool
+func (p *evictionPool) fill(tables *samplingTables, count int, target evictable) {
+	for j := 0; j < count; j++ {
+		bucket := tables.pick()
+		if item, score := target.evictionCandidate(bucket); item != nil {
+			p.Lock()
+			p.add(poolEntry{bucket, item, score})
+			p.Unlock()
+		}
+	}
+}
+
+// Adds the entry, unless its item is already pooled, dropping the highest
+// scored entry if the pool is full. The caller must hold the lock.
+func (p *evictionPool) add(entry poolEntry) {
+	at := len(p.entries)
+	for i, e := range p.entries {
+		if e.item == entry.item {
+			return
+		}
+		if at == len(p.entries) && entry.score < e.score {
+			at = i
+		}
+	}
+	if at == p.size {
+		return
+	}
+	p.entries = append(p.entries, poolEntry{})
+	copy(p.entries[at+1:], p.entries[at:])
+	p.entries[at] = entry
+	if len(p.entries) > p.size {
+		p.entries = p.entries[:p.size]
+	}
+}
+
+// Removes and returns the lowest scored candidate which is still cached and
+// whose refreshed score is still the lowest, along with that score. Unless
+// round is nil, it and the candidates left in the pool are appended to round.
+func (p *evictionPool) take(target evictable, round *[]*Item) (int, *Item, float64) {
+	p.Lock()
+	defer p.Unlock()
+	// an entry can only be pushed back once per entry in the pool, since it
+	// goes back with its fresh score
+	for attempts := 2 * p.size; len(p.entries) > 0 && attempts > 0; attempts-- {
+		entry := p.entries[0]
+		copy(p.entries, p.entries[1:])
+		p.entries = p.entries[:len(p.entries)-1]
+
+		score, ok := target.rescore(entry.bucket, entry.item)
+		if !ok {
+			continue
+		}
+		if len(p.entries) > 0 && score > p.entries[0].score {
+			entry.score = score
+			p.add(entry)
+			continue
+		}
+		if round != nil {
+			*round = append(*round, entry.item)
+			for _, e := range p.entries {
+				*round = append(*round, e.item)
+			}
+		}
+		return entry.bucket, entry.item, score
+	}
+	return 0, nil, 0
+}
+
+// Returns the pooled candidates which are still evictable, lowest scored
+// first, leaving them in the pool
+func (p *evictionPool) items(target evictable) []*Item {
+	p.Lock()
+	defer p.Unlock()
+	items := make([]*Item, 0, len(p.entries))
+	for _, entry := range p.entries {
+		if _, ok := target.rescore(entry.bucket, entry.item); ok {
+			items = append(items, entry.item)
+		}
+	}
+	return items
+}
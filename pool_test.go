@@ -0,0 +1,109 @@
+package ccache
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type PoolTests struct{}
+
+func Test_Pool(t *testing.T) {
+	Expectify(new(PoolTests), t)
+}
+
+func (_ PoolTests) KeepsTheLowestScores() {
+	p := newEvictionPool(3)
+	items := make([]*Item, 5)
+	for i, score := range []float64{4, 1, 3, 0, 2} {
+		items[i] = &Item{key: strconv.Itoa(i)}
+		p.add(poolEntry{0, items[i], score})
+	}
+	p.add(poolEntry{0, items[3], 0})
+	Expect(len(p.entries)).To.Equal(3)
+	Expect(p.entries[0].item).To.Equal(items[3])
+	Expect(p.entries[1].item).To.Equal(items[1])
+	Expect(p.entries[2].item).To.Equal(items[4])
+}
+
+func (_ PoolTests) IsDisabledByDefault() {
+	Expect(New(Configure()).pool == nil).To.Equal(true)
+	Expect(New(Configure().EvictionPool(16)).pool.size).To.Equal(16)
+}
+
+func (_ PoolTests) TakeSkipsItemsNoLongerCached() {
+	cache := New(Configure().EvictionPool(4))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	spice, worm := cache.Get("spice"), cache.Get("worm")
+	cache.pool.add(poolEntry{cache.bucketIndex("spice"), spice, 0})
+	cache.pool.add(poolEntry{cache.bucketIndex("worm"), worm, 1})
+
+	cache.Delete("spice")
+	bucket, item, _ := cache.pool.take(cache, nil)
+	Expect(item).To.Equal(worm)
+	Expect(bucket).To.Equal(cache.bucketIndex("worm"))
+	Expect(len(cache.pool.entries)).To.Equal(0)
+}
+
+func (_ PoolTests) TakeRescoresTheBestCandidate() {
+	cache := New(Configure().EvictionPool(4))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	spice, worm := cache.bucket("spice").peek("spice"), cache.bucket("worm").peek("worm")
+	cache.pool.add(poolEntry{cache.bucketIndex("spice"), spice, 0})
+	cache.pool.add(poolEntry{cache.bucketIndex("worm"), worm, 1})
+
+	// spice got popular since it was pooled
+	for i := 0; i < 5; i++ {
+		cache.Get("spice")
+	}
+	_, item, _ := cache.pool.take(cache, nil)
+	Expect(item).To.Equal(worm)
+	Expect(len(cache.pool.entries)).To.Equal(1)
+	Expect(cache.pool.entries[0].score).To.Equal(5.0)
+}
+
+func (_ PoolTests) EvictsWithThePool() {
+	cache := New(Configure().MaxSize(50).ItemsToPrune(1).EvictionPool(16))
+	for i := 0; i < 500; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	Expect(cache.size).To.Equal(int64(50))
+	Expect(len(cache.pool.entries) <= 16).To.Equal(true)
+}
+
+// Compares the hit ratio of the plain sampler and of the eviction pool over a
+// zipf workload, reported as the hit-ratio metric:
+//
+//	go test -run none -bench EvictionPool
+func BenchmarkEvictionPool(b *testing.B) {
+	for _, pool := range []int{0, 16} {
+		name := "sampler"
+		if pool > 0 {
+			name = "pool"
+		}
+		b.Run(name, func(b *testing.B) {
+			cache := New(Configure().MaxSize(1000).ItemsToPrune(1).Candidates(5).EvictionPool(pool))
+			zipf := rand.NewZipf(rand.New(rand.NewSource(7)), 1.01, 1, 100000)
+			keys := make([]string, 1<<16)
+			for i := range keys {
+				keys[i] = strconv.FormatUint(zipf.Uint64(), 10)
+			}
+			hits := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := keys[i&(len(keys)-1)]
+				if cache.Get(key) != nil {
+					hits++
+				} else {
+					cache.Set(key, i, time.Minute)
+				}
+			}
+			b.ReportMetric(float64(hits)/float64(b.N), "hit-ratio")
+		})
+	}
+}
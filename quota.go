@@ -0,0 +1,303 @@
+package ccache
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// The bounds on the size of a backend's objects, see BackendQuota
+type quota struct {
+	min int64
+	max int64
+}
+
+// The size and number of the cached objects of a backend, updated
+// atomically as they're inserted and deleted
+type backendUsage struct {
+	size    int64
+	items   int64
+	evicted uint64
+	quota   quota
+}
+
+// A snapshot of the usage of a backend, see Cache.BackendUsage
+type BackendUsage struct {
+	Size    int64  // the total size of the backend's objects
+	Items   int64  // the number of the backend's objects
+	Min     int64  // the guaranteed minimum of its quota
+	Max     int64  // the hard cap of its quota, 0 without one
+	Share   int64  // its fair share of the cache, with quotas
+	Evicted uint64 // objects evicted for the backend being over its quota or share
+}
+
+// The usage of every backend with objects in a Cache. Only page objects,
+// those set by SetPage and its variants, belong to a backend.
+type backends struct {
+	usage sync.Map // backend -> *backendUsage
+	// the number of backends with objects
+	active   int64
+	quotas   map[uint64]quota
+	fallback quota
+	// whether quotas and fair sharing are enforced, which they are once any
+	// quota is configured
+	enforced bool
+}
+
+func newBackends(config *Configuration) *backends {
+	b := &backends{
+		quotas:   make(map[uint64]quota, len(config.backendQuotas)),
+		enforced: len(config.backendQuotas) > 0 || config.defaultQuota != nil,
+	}
+	if config.defaultQuota != nil {
+		b.fallback = *config.defaultQuota
+	}
+	for backend, q := range config.backendQuotas {
+		b.quotas[backend] = q
+	}
+	return b
+}
+
+// The usage of the backend, created the first time it's needed
+func (b *backends) get(backend uint64) *backendUsage {
+	if u, ok := b.usage.Load(backend); ok {
+		return u.(*backendUsage)
+	}
+	u, _ := b.usage.LoadOrStore(backend, &backendUsage{quota: b.quotaOf(backend)})
+	return u.(*backendUsage)
+}
+
+func (b *backends) quotaOf(backend uint64) quota {
+	if q, ok := b.quotas[backend]; ok {
+		return q
+	}
+	return b.fallback
+}
+
+// The usage of the item's backend, or nil if it isn't a page object or its
+// backend has none
+func (b *backends) of(item *Item) *backendUsage {
+	backend, _, ok := splitKey(item.key)
+	if !ok {
+		return nil
+	}
+	if u, ok := b.usage.Load(backend); ok {
+		return u.(*backendUsage)
+	}
+	return nil
+}
+
+func (b *backends) insert(item *Item) {
+	backend, _, ok := splitKey(item.key)
+	if !ok {
+		return
+	}
+	for {
+		u := b.get(backend)
+		// a usage whose items are negative has been retired by drop and is
+		// about to be deleted, the item belongs in the next one
+		items := atomic.LoadInt64(&u.items)
+		if items < 0 || !atomic.CompareAndSwapInt64(&u.items, items, items+1) {
+			continue
+		}
+		if items == 0 {
+			atomic.AddInt64(&b.active, 1)
+		}
+		atomic.AddInt64(&u.size, item.size)
+		return
+	}
+}
+
+// Takes the item out of its backend's usage. The usage is kept when the
+// backend has no more objects, along with its Evicted count, until the
+// backend is deleted.
+func (b *backends) remove(item *Item) {
+	u := b.of(item)
+	if u == nil {
+		return
+	}
+	atomic.AddInt64(&u.size, -item.size)
+	if atomic.AddInt64(&u.items, -1) == 0 {
+		atomic.AddInt64(&b.active, -1)
+	}
+}
+
+// Drops the usage of a deleted backend, unless objects of the backend were
+// set since
+func (b *backends) drop(backend uint64) {
+	u, ok := b.usage.Load(backend)
+	if !ok {
+		return
+	}
+	// no insert can claim the usage once it's retired, and none can store
+	// another until it's deleted
+	if atomic.CompareAndSwapInt64(&u.(*backendUsage).items, 0, -1) {
+		b.usage.Delete(backend)
+	}
+}
+
+// The backend's fair share of capacity: an equal part of it for every
+// backend with objects, but no less than its guaranteed minimum and no more
+// than its hard cap
+func (b *backends) share(u *backendUsage, capacity int64) int64 {
+	share := capacity
+	if active := atomic.LoadInt64(&b.active); active > 1 {
+		share = capacity / active
+	}
+	if share < u.quota.min {
+		share = u.quota.min
+	}
+	if u.quota.max > 0 && share > u.quota.max {
+		share = u.quota.max
+	}
+	return share
+}
+
+// The backend furthest over its fair share, if any is over
+func (b *backends) overShare(capacity int64) (uint64, *backendUsage) {
+	var over *backendUsage
+	backend, most := uint64(0), int64(0)
+	b.usage.Range(func(key, value interface{}) bool {
+		u := value.(*backendUsage)
+		if excess := atomic.LoadInt64(&u.size) - b.share(u, capacity); excess > most {
+			backend, over, most = key.(uint64), u, excess
+		}
+		return true
+	})
+	return backend, over
+}
+
+// Whether evicting the item would take its backend under the guaranteed
+// minimum of its quota
+func (b *backends) protected(item *Item) bool {
+	if !b.enforced {
+		return false
+	}
+	u := b.of(item)
+	return u != nil && atomic.LoadInt64(&u.size)-item.size < u.quota.min
+}
+
+func (b *backends) snapshot(capacity int64) map[uint64]BackendUsage {
+	usages := make(map[uint64]BackendUsage)
+	b.usage.Range(func(key, value interface{}) bool {
+		if u := value.(*backendUsage); atomic.LoadInt64(&u.items) >= 0 {
+			usages[key.(uint64)] = b.usageOf(u, capacity)
+		}
+		return true
+	})
+	return usages
+}
+
+func (b *backends) usageOf(u *backendUsage, capacity int64) BackendUsage {
+	usage := BackendUsage{
+		Size:    atomic.LoadInt64(&u.size),
+		Items:   atomic.LoadInt64(&u.items),
+		Min:     u.quota.min,
+		Max:     u.quota.max,
+		Evicted: atomic.LoadUint64(&u.evicted),
+	}
+	if b.enforced {
+		usage.Share = b.share(u, capacity)
+	}
+	return usage
+}
+
+func (b *backends) clear() {
+	b.usage.Range(func(key, value interface{}) bool {
+		b.usage.Delete(key)
+		return true
+	})
+	atomic.StoreInt64(&b.active, 0)
+}
+
+// The current usage of the backend, nothing but its quota if it has no
+// objects
+func (c *Cache) BackendUsage(backend uint64) BackendUsage {
+	if u, ok := c.backends.usage.Load(backend); ok {
+		if usage := c.backends.usageOf(u.(*backendUsage), c.capacity()); usage.Items >= 0 {
+			return usage
+		}
+	}
+	return c.backends.usageOf(&backendUsage{quota: c.backends.quotaOf(backend)}, c.capacity())
+}
+
+// Evicts objects of the item's backend while it's over its hard cap
+func (c *Cache) enforceQuota(item *Item) {
+	if backend, _, ok := splitKey(item.key); ok {
+		if u := c.backends.of(item); u != nil {
+			c.enforceCap(backend, u)
+		}
+	}
+}
+
+func (c *Cache) enforceCap(backend uint64, u *backendUsage) {
+	if u.quota.max == 0 {
+		return
+	}
+	for atomic.LoadInt64(&u.size) > u.quota.max {
+		victim, score := c.backendVictim(backend)
+		if victim == nil {
+			return
+		}
+		if c.evictFor(victim, EvictedOverQuota, score) {
+			atomic.AddUint64(&u.evicted, 1)
+		}
+	}
+}
+
+// Enforces the quotas of every backend, for SetMaxSize's shrink: evicts the
+// objects of the backends over their hard cap, then those of the backends
+// over their fair share of the new max size, before evicting for space.
+func (c *Cache) enforceQuotas() {
+	if !c.backends.enforced {
+		return
+	}
+	c.backends.usage.Range(func(key, value interface{}) bool {
+		c.enforceCap(key.(uint64), value.(*backendUsage))
+		return true
+	})
+	c.evictOverShare()
+}
+
+// Evicts objects of the backends over their fair share while the cache is
+// over its max size, leaving the rest to evict
+func (c *Cache) evictOverShare() {
+	for misses := 0; misses < evictRetries && atomic.LoadInt64(&c.size) > c.capacity(); {
+		backend, u := c.backends.overShare(c.capacity())
+		if u == nil {
+			return
+		}
+		victim, score := c.backendVictim(backend)
+		if victim == nil {
+			misses++
+			continue
+		}
+		if c.evictFor(victim, EvictedForSpace, score) {
+			atomic.AddUint64(&u.evicted, 1)
+		}
+	}
+}
+
+// The object of the backend to evict first, out of candidates sampled from
+// the buckets' backend index, and its score
+func (c *Cache) backendVictim(backend uint64) (*Item, float64) {
+	buckets := c.samplingBuckets()
+	candidates := int(atomic.LoadInt64(&c.params.candidates))
+	if candidates == 0 {
+		candidates = 1
+	}
+	var victim *Item
+	min := 0.0
+	start := rand.Intn(len(buckets))
+	for i := 0; i < len(buckets) && candidates > 0; i++ {
+		item, score := buckets[(start+i)%len(buckets)].backendCandidate(backend, c.eval)
+		if item == nil || (c.tracking && item.pinned()) {
+			continue
+		}
+		if victim == nil || score < min {
+			victim, min = item, score
+		}
+		candidates--
+	}
+	return victim, min
+}
@@ -0,0 +1,161 @@
+package ccache
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type QuotaTests struct{}
+
+func Test_Quota(t *testing.T) {
+	Expectify(new(QuotaTests), t)
+}
+
+func (_ QuotaTests) TracksTheUsageOfBackends() {
+	cache := New(Configure())
+	cache.SetPage([]*Request{{Backend: 1, Uri: 1, Obj: &SizedItem{1, 4}}, {Backend: 1, Uri: 2, Obj: &SizedItem{2, 6}}}, time.Minute)
+	cache.SetPage(page(2, 1), time.Minute)
+	cache.Set("spice", "flow", time.Minute)
+	Expect(cache.BackendUsage(1)).To.Equal(BackendUsage{Size: 10, Items: 2})
+
+	cache.Delete(buildKey(1, 2))
+	cache.SetPage([]*Request{{Backend: 1, Uri: 1, Obj: &SizedItem{1, 3}}}, time.Minute)
+	Expect(cache.BackendUsage(1)).To.Equal(BackendUsage{Size: 3, Items: 1})
+	backends := cache.Stats().Backends
+	Expect(len(backends)).To.Equal(2)
+	Expect(backends[2].Items).To.Equal(int64(1))
+
+	cache.Clear()
+	Expect(cache.BackendUsage(1).Items).To.Equal(int64(0))
+}
+
+func (_ QuotaTests) CapsABackend() {
+	cache := New(Configure().BackendQuota(1, 0, 10))
+	for i := 0; i < 20; i++ {
+		cache.SetPage(page(1, uint64(i)), time.Minute)
+		cache.SetPage(page(2, uint64(i)), time.Minute)
+	}
+	usage := cache.BackendUsage(1)
+	Expect(usage.Size).To.Equal(int64(10))
+	Expect(usage.Max).To.Equal(int64(10))
+	Expect(usage.Evicted).To.Equal(uint64(10))
+	Expect(cache.CountBackend(1)).To.Equal(10)
+	Expect(cache.CountBackend(2)).To.Equal(20)
+	Expect(cache.Stats().Evictions[EvictedOverQuota]).To.Equal(uint64(10))
+}
+
+func (_ QuotaTests) GuaranteesTheMinimum() {
+	cache := New(Configure().MaxSize(20).ItemsToPrune(1).BackendQuota(2, 5, 0))
+	cache.SetPage(page(2, 1, 2, 3, 4, 5), time.Minute)
+	for i := 0; i < 100; i++ {
+		cache.SetPage(page(1, uint64(i)), time.Minute)
+	}
+	Expect(cache.CountBackend(2)).To.Equal(5)
+	Expect(cache.BackendUsage(1).Size).To.Equal(int64(15))
+	checkSize(cache, 20)
+
+	// objects which don't belong to a backend are evicted instead
+	cache.DeleteBackend(1)
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	Expect(cache.CountBackend(2)).To.Equal(5)
+	checkSize(cache, 20)
+}
+
+func (_ QuotaTests) EvictsBackendsOverTheirShareFirst() {
+	cache := New(Configure().MaxSize(100).ItemsToPrune(1).DefaultBackendQuota(0, 0))
+	for i := 0; i < 100; i++ {
+		cache.SetPage(page(1, uint64(i)), time.Minute)
+	}
+	for i := 0; i < 30; i++ {
+		cache.SetPage(page(2, uint64(i)), time.Minute)
+	}
+	Expect(cache.CountBackend(2)).To.Equal(30)
+	usage := cache.BackendUsage(1)
+	Expect(usage.Size).To.Equal(int64(70))
+	Expect(usage.Share).To.Equal(int64(50))
+	Expect(usage.Evicted).To.Equal(uint64(30))
+	checkSize(cache, 100)
+}
+
+func (_ QuotaTests) KeepsUsageWhileInUse() {
+	cache := New(Configure().MaxSize(100).ItemsToPrune(2).BackendQuota(0, 10, 30).DefaultBackendQuota(0, 0))
+	stress(func(r *rand.Rand) {
+		backend, uri := uint64(r.Intn(4)), uint64(r.Intn(50))
+		switch r.Intn(10) {
+		case 0:
+			cache.Delete(buildKey(backend, uri))
+		case 1:
+			cache.Set(strconv.Itoa(r.Intn(50)), uri, time.Minute)
+		case 2, 3:
+			cache.GetPage(page(backend, uri, uri+1))
+		default:
+			cache.SetPage(page(backend, uri, uri+1), time.Minute)
+		}
+	})
+	cache.Stop()
+	for backend := uint64(0); backend < 4; backend++ {
+		size := int64(0)
+		for _, uri := range cache.KeysForBackend(backend) {
+			size += cache.bucket(buildKey(backend, uri)).peek(buildKey(backend, uri)).size
+		}
+		usage := cache.BackendUsage(backend)
+		Expect(usage.Size).To.Equal(size)
+		Expect(usage.Items).To.Equal(int64(cache.CountBackend(backend)))
+	}
+	Expect(cache.BackendUsage(0).Size <= 30).To.Equal(true)
+}
+
+func (_ QuotaTests) KeepsTheUsageOfBackendsUntilTheyreDeleted() {
+	cache := New(Configure().BackendQuota(3, 0, 1))
+	Expect(cache.BackendUsage(1)).To.Equal(BackendUsage{Share: 5000})
+	Expect(cache.BackendUsage(3)).To.Equal(BackendUsage{Max: 1, Share: 1})
+	Expect(len(cache.Stats().Backends)).To.Equal(0)
+
+	cache.SetPage(page(3, 1), time.Minute)
+	cache.SetPage(page(3, 2), time.Minute)
+	Expect(cache.BackendUsage(3).Evicted).To.Equal(uint64(1))
+
+	// replacing the backend's only object
+	uri := cache.KeysForBackend(3)[0]
+	cache.SetPage(page(3, uri), time.Minute)
+	Expect(cache.BackendUsage(3).Evicted).To.Equal(uint64(1))
+	Expect(cache.BackendUsage(3).Items).To.Equal(int64(1))
+
+	cache.SetPage(page(1, 1), time.Minute)
+	cache.Delete(buildKey(1, 1))
+	cache.Delete(buildKey(3, uri))
+	backends := cache.Stats().Backends
+	Expect(len(backends)).To.Equal(2)
+	Expect(backends[3].Evicted).To.Equal(uint64(1))
+	Expect(backends[1].Items).To.Equal(int64(0))
+
+	cache.DeleteBackend(1)
+	cache.DeleteBackend(3)
+	Expect(len(cache.Stats().Backends)).To.Equal(0)
+	Expect(cache.BackendUsage(3)).To.Equal(BackendUsage{Max: 1, Share: 1})
+
+	cache.SetPage(page(1, 4), time.Minute)
+	Expect(cache.BackendUsage(1).Items).To.Equal(int64(1))
+}
+
+func (_ QuotaTests) ShrinkingEnforcesTheShares() {
+	cache := New(Configure().MaxSize(20).ItemsToPrune(1).DefaultBackendQuota(0, 0))
+	for uri := uint64(0); uri < 15; uri++ {
+		cache.SetPage(page(1, uri), time.Minute)
+	}
+	for uri := uint64(0); uri < 5; uri++ {
+		cache.SetPage(page(2, uri), time.Minute)
+	}
+	cache.SetMaxSize(10)
+	waitForShrink(&cache.evictor)
+	checkSize(cache, 10)
+	// backend 1 was the one over its share of the new max size
+	Expect(cache.CountBackend(2)).To.Equal(5)
+	Expect(cache.BackendUsage(1).Evicted).To.Equal(uint64(10))
+}
@@ -0,0 +1,105 @@
+package ccache
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// shards are the buckets a Cache hashes its keys into. Reshard replaces them
+// as a whole, so they're only accessed through Cache.table.
+type shards struct {
+	buckets []*bucket
+	mask    uint32
+	hasher  func(key string) uint32
+}
+
+func newShards(count int, config *Configuration, aging *aging) *shards {
+	s := &shards{
+		buckets: make([]*bucket, count),
+		mask:    uint32(count) - 1,
+		hasher:  config.keyHasher,
+	}
+	for i := range s.buckets {
+		s.buckets[i] = NewBucket(config.initBucketSize, config.updateRatio)
+		s.buckets[i].aging = aging
+		s.buckets[i].memory = config.memory
+		s.buckets[i].tracking = config.tracking
+		s.buckets[i].backends = make(backendIndex)
+	}
+	return s
+}
+
+func (s *shards) bucket(key string) *bucket {
+	return s.buckets[s.index(key)]
+}
+
+func (s *shards) index(key string) int {
+	return int(hashKey(key, s.hasher) & s.mask)
+}
+
+// A Reshard in progress, moving the items of the from buckets to the to
+// buckets one bucket at a time
+type migration struct {
+	from *shards
+	to   *shards
+	// from's buckets followed by to's, for sampling eviction candidates
+	all []*bucket
+}
+
+// Changes the number of buckets, which must be a power of 2, while the cache
+// is in use. Items are moved to the new buckets one old bucket at a time:
+// gets of the keys of a bucket which hasn't moved yet keep using the old
+// bucket, while sets and deletes of a moving bucket's keys wait for it to be
+// moved and then go to the new buckets. Reshard returns once every item has
+// moved. Concurrent calls to Reshard, and Snapshot, wait for each other.
+func (c *Cache) Reshard(count uint32) error {
+	if count == 0 || count&(count-1) != 0 {
+		return fmt.Errorf("ccache: bucket count %d isn't a power of 2", count)
+	}
+	c.reshardLock.Lock()
+	defer c.reshardLock.Unlock()
+
+	from := c.table()
+	to := newShards(int(count), c.Configuration, c.aging)
+	m := &migration{
+		from: from,
+		to:   to,
+		all:  append(append([]*bucket(nil), from.buckets...), to.buckets...),
+	}
+	atomic.StorePointer(&c.migration, unsafe.Pointer(m))
+	// resample over both generations of buckets
+	c.rebuildSamplingTables(c.buildSamplingTables)
+
+	for _, bucket := range from.buckets {
+		bucket.migrate(to)
+		c.retired.add(&bucket.stats)
+		runtime.Gosched()
+	}
+
+	atomic.StorePointer(&c.shards, unsafe.Pointer(to))
+	atomic.StorePointer(&c.migration, nil)
+	c.setBuckets(int(count))
+	c.rebuildSamplingTables(c.buildSamplingTables)
+	return nil
+}
+
+// The current buckets
+func (c *Cache) table() *shards {
+	return (*shards)(atomic.LoadPointer(&c.shards))
+}
+
+// The Reshard in progress, or nil
+func (c *Cache) migrating() *migration {
+	return (*migration)(atomic.LoadPointer(&c.migration))
+}
+
+// The buckets eviction candidates are sampled from. The indexes of the
+// sampling tables are indexes in this slice.
+func (c *Cache) samplingBuckets() []*bucket {
+	if m := c.migrating(); m != nil {
+		return m.all
+	}
+	return c.table().buckets
+}
@@ -0,0 +1,173 @@
+package ccache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	. "github.com/karlseguin/expect"
+)
+
+type ReshardTests struct{}
+
+func Test_Reshard(t *testing.T) {
+	Expectify(new(ReshardTests), t)
+}
+
+func (_ ReshardTests) GrowsTheBucketCount() {
+	cache := New(Configure().Buckets(4).MaxSize(5000))
+	for i := 0; i < 1000; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	Expect(cache.Reshard(64)).To.Equal(nil)
+	assertResharded(cache, 64, 1000)
+}
+
+func (_ ReshardTests) ShrinksTheBucketCount() {
+	cache := New(Configure().Buckets(64).MaxSize(5000))
+	for i := 0; i < 1000; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	Expect(cache.Reshard(2)).To.Equal(nil)
+	assertResharded(cache, 2, 1000)
+}
+
+func (_ ReshardTests) RejectsCountsWhichArentPowersOf2() {
+	cache := New(Configure())
+	Expect(cache.Reshard(0)).Not.To.Equal(nil)
+	Expect(cache.Reshard(24)).Not.To.Equal(nil)
+	Expect(len(cache.table().buckets)).To.Equal(16)
+}
+
+func (_ ReshardTests) WritesGoToTheNewBucketsOnceMoved() {
+	cache := New(Configure().Buckets(2))
+	keys := make([][]string, 2)
+	for i := 0; len(keys[0]) < 3 || len(keys[1]) < 3; i++ {
+		key := strconv.Itoa(i)
+		cache.Set(key, i, time.Minute)
+		index := cache.bucketIndex(key)
+		keys[index] = append(keys[index], key)
+	}
+
+	// a migration which only moved the first bucket
+	from := cache.table()
+	to := newShards(8, cache.Configuration, cache.aging)
+	m := &migration{from: from, to: to, all: append(append([]*bucket(nil), from.buckets...), to.buckets...)}
+	cache.migration = unsafe.Pointer(m)
+	from.buckets[0].migrate(to)
+
+	moved, stayed := keys[0], keys[1]
+	Expect(cache.Get(moved[0]).Value()).To.Equal(mustAtoi(moved[0]))
+	Expect(cache.bucket(moved[0])).To.Equal(to.bucket(moved[0]))
+	Expect(cache.bucket(stayed[0])).To.Equal(from.buckets[1])
+
+	cache.Set(moved[1], "flow", time.Minute)
+	Expect(to.bucket(moved[1]).peek(moved[1]).Value()).To.Equal("flow")
+	Expect(cache.Delete(moved[2])).To.Equal(true)
+	Expect(to.bucket(moved[2]).peek(moved[2])).To.Equal(nil)
+
+	// writes which picked the old bucket before it moved are redone
+	_, _, ok := from.buckets[0].setItem(newItem(moved[0], "sand", getDefaultReqInfo("sand"), 0))
+	Expect(ok).To.Equal(false)
+	_, ok = from.buckets[0].delete(moved[0])
+	Expect(ok).To.Equal(false)
+
+	cache.Set(stayed[0], "must", time.Minute)
+	Expect(from.buckets[1].peek(stayed[0]).Value()).To.Equal("must")
+}
+
+func (_ ReshardTests) KeepsStats() {
+	cache := New(Configure().Buckets(4))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Get("spice")
+	cache.Get("worm")
+	Expect(cache.Reshard(8)).To.Equal(nil)
+	cache.Get("spice")
+
+	stats := cache.Stats()
+	Expect(len(stats.Buckets)).To.Equal(8)
+	Expect(stats.Sets).To.Equal(uint64(1))
+	Expect(stats.Hits).To.Equal(uint64(2))
+	Expect(stats.Misses).To.Equal(uint64(1))
+}
+
+func (_ ReshardTests) RebuildsTheSamplingTables() {
+	cache := New(Configure().Buckets(4).MaxSize(100).ItemsToPrune(1))
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	Expect(cache.Reshard(32)).To.Equal(nil)
+	tables := (*samplingTables)(cache.tables)
+	Expect(len(tables.tableU)).To.Equal(32)
+
+	cache.Set("spice", "flow", time.Minute)
+	checkSize(cache, 100)
+}
+
+func (_ ReshardTests) BoundsTheCandidatesByTheNewBucketCount() {
+	cache := New(Configure().Buckets(4).Candidates(4))
+	Expect(cache.Reshard(64)).To.Equal(nil)
+	cache.SetCandidates(32)
+	Expect(cache.params.candidates).To.Equal(int64(32))
+	cache.SetCandidates(65)
+	Expect(cache.params.candidates).To.Equal(int64(32))
+
+	Expect(cache.Reshard(8)).To.Equal(nil)
+	Expect(cache.params.candidates).To.Equal(int64(8))
+}
+
+func (_ ReshardTests) ReshardsWhileInUse() {
+	cache := New(Configure().Buckets(4).MaxSize(150).ItemsToPrune(5).EvictionPool(8))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, count := range []uint32{64, 2, 16, 128, 8} {
+			cache.Reshard(count)
+		}
+	}()
+	stressCache(cache)
+	wg.Wait()
+	assertResharded(cache, 8, -1)
+}
+
+func (_ ReshardTests) KeepsSweeping() {
+	cache := New(Configure().Buckets(16))
+	cache.Set("spice", "flow", -time.Minute)
+	cache.sweeper.bucket = 15
+	Expect(cache.Reshard(4)).To.Equal(nil)
+	Expect(cache.sweepPass(10)).To.Equal(1)
+}
+
+// Checks that every item is in the bucket its key hashes to, and that the
+// size adds up. count is the expected number of items, or -1.
+func assertResharded(cache *Cache, buckets int, count int) {
+	cache.Stop()
+	t := cache.table()
+	Expect(len(t.buckets)).To.Equal(buckets)
+	Expect(cache.migrating()).To.Equal((*migration)(nil))
+	items, total := 0, int64(0)
+	for i, bucket := range t.buckets {
+		Expect(bucket.isMoved()).To.Equal(false)
+		for _, item := range bucket.arr {
+			Expect(t.index(item.key)).To.Equal(i)
+			Expect(bucket.contains(item)).To.Equal(true)
+			items++
+			total += item.size
+		}
+	}
+	Expect(cache.size).To.Equal(total)
+	if count != -1 {
+		Expect(items).To.Equal(count)
+		for i := 0; i < count; i++ {
+			Expect(cache.Get(strconv.Itoa(i)).Value()).To.Equal(i)
+		}
+	}
+}
+
+func mustAtoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,121 @@
+package ccache
+
+import "math/rand"
+
+const EPSILON = 0.0000001
+
+type samplingTables struct {
+	tableU []float64
+	tableK []int
+	// the number of items the tables were built over
+	items int
+}
+
+// Builds the alias tables from the number of items in each bucket
+func buildSamplingTables(nums []int) *samplingTables {
+	n := len(nums)
+	tableU := make([]float64, n, n)
+	tableK := make([]int, n, n)
+
+	for i := range tableK {
+		tableK[i] = -1
+	}
+
+	overfull := []int{}
+	underfull := []int{}
+
+	sum := 0
+	for i := range tableU {
+		sum += nums[i]
+		tableU[i] = float64(n) * float64(nums[i])
+	}
+
+	if sum == 0 {
+		// nothing to sample, every bucket maps to itself
+		for i := range tableU {
+			tableU[i] = 1
+			tableK[i] = i
+		}
+		return &samplingTables{tableU, tableK, 0}
+	}
+
+	for i := range tableU {
+		tableU[i] /= float64(sum)
+
+		if tableU[i]-1 > EPSILON {
+			overfull = append(overfull, i)
+		} else if tableU[i] < 1-EPSILON && tableK[i] < 0 {
+			underfull = append(underfull, i)
+		} else {
+			tableK[i] = i
+		}
+	}
+
+	for len(overfull) > 0 && len(underfull) > 0 {
+		i := overfull[len(overfull)-1]
+		overfull = overfull[:len(overfull)-1]
+		j := underfull[len(underfull)-1]
+		underfull = underfull[:len(underfull)-1]
+
+		tableK[j] = i
+		tableU[i] = tableU[i] + tableU[j] - 1
+
+		if tableU[i]-1 > EPSILON {
+			overfull = append(overfull, i)
+		} else if tableU[i] < 1-EPSILON && tableK[i] < 0 {
+			underfull = append(underfull, i)
+		} else {
+			tableK[i] = i
+		}
+	}
+
+	// whatever is left is off by rounding errors only
+	for _, i := range append(overfull, underfull...) {
+		tableU[i] = 1
+		tableK[i] = i
+	}
+
+	return &samplingTables{tableU, tableK, sum}
+}
+
+// Picks a bucket index using the alias method
+func (t *samplingTables) pick() int {
+	n := len(t.tableU)
+	x := rand.Float64()
+
+	i := int(float64(n) * x)
+	y := float64(n)*x - float64(i)
+	if y < t.tableU[i] {
+		return i
+	}
+	return t.tableK[i]
+}
+
+// Draws count candidates, each from a bucket picked by the alias method, and
+// returns the one with the lowest score along with its bucket index. Returns
+// a nil item if no sampled bucket had an evictable item. Unless round is nil,
+// the candidates drawn are appended to it.
+func (t *samplingTables) candidate(count int, target evictable, round *[]*Item) (int, *Item, float64) {
+	var minBucket int
+	var minItem *Item
+	var minVal float64
+
+	for j := 0; j < count; j++ {
+		bucket := t.pick()
+		curItem, curVal := target.evictionCandidate(bucket)
+
+		// Possible nil result, purposely left there to avoid infinite loop
+		if curItem == nil {
+			continue
+		}
+		if round != nil {
+			*round = append(*round, curItem)
+		}
+		if minItem == nil || curVal < minVal {
+			minItem = curItem
+			minVal = curVal
+			minBucket = bucket
+		}
+	}
+	return minBucket, minItem, minVal
+}
@@ -0,0 +1,319 @@
+package ccache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshots start with this magic, followed by the format version as a uvarint
+const snapshotMagic = "ccache-snapshot"
+
+// The current snapshot format. Each item is written as a record made of a
+// 1 marker byte, then: key, expires, accCount, frequency, createTS, accessTs,
+// reqInfo.TimeEntered, reqInfo.ReqSize, reqInfo.MissingSize, value. Strings and
+// the encoded value are uvarint length prefixed, times are varint UnixNano and
+// floats are their IEEE 754 bits as uvarints. A 0 byte ends the snapshot.
+// Version 3 snapshots are the same, except that page keys were a 0 byte
+// followed by the backend and the uri, big endian. Version 2 snapshots don't
+// have the frequency either, which is aged by FrequencyHalfLife, so their
+// items are restored with their accCount instead. Version 1 snapshots are
+// version 2 snapshots with the current page keys.
+const snapshotVersion = 4
+
+var ErrNotASnapshot = errors.New("ccache: not a snapshot")
+
+// A Codec turns cached values into bytes and back, for Snapshot and RestoreFrom
+type Codec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// GobCodec is the default Codec. Values other than gob's basic types must be
+// registered with gob.Register.
+type GobCodec struct{}
+
+func (GobCodec) Encode(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Writes every item of the cache, along with the metadata the evaluators rely
+// on (access count, aged frequency, creation and access times, request info),
+// to w. The items are collected one bucket at a time, so a snapshot of a cache
+// under load isn't a consistent point in time, and are encoded and written
+// once collected, so a slow writer doesn't hold up Reshard or DeleteBackend.
+func (c *Cache) Snapshot(w io.Writer) error {
+	items := c.items()
+	sw := &snapshotWriter{w: bufio.NewWriter(w)}
+	sw.raw(snapshotMagic)
+	sw.uvarint(snapshotVersion)
+	for _, item := range items {
+		value, err := c.codec.Encode(item.value)
+		if err != nil {
+			return fmt.Errorf("ccache: encoding %q: %w", item.key, err)
+		}
+		sw.byte(1)
+		sw.string(item.key)
+		sw.varint(atomic.LoadInt64(&item.expires))
+		sw.varint(item.AccessCount())
+		sw.varint(item.Frequency())
+		sw.varint(item.Created().UnixNano())
+		sw.varint(item.Accessed().UnixNano())
+		sw.varint(item.reqInfo.TimeEntered.UnixNano())
+		sw.float(item.reqInfo.ReqSize)
+		sw.float(item.reqInfo.MissingSize)
+		sw.bytes(value)
+		if sw.err != nil {
+			return sw.err
+		}
+	}
+	sw.byte(0)
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+// The items of every bucket. Like DeleteBackend, waits for a Reshard in
+// progress to complete.
+func (c *Cache) items() []*Item {
+	c.reshardLock.Lock()
+	defer c.reshardLock.Unlock()
+	var items []*Item
+	for _, bucket := range c.table().buckets {
+		bucket.RLock()
+		items = append(items, bucket.arr...)
+		bucket.RUnlock()
+	}
+	return items
+}
+
+// Loads the items of a snapshot written by Snapshot into the cache, metadata
+// included. Restored items replace existing items with the same key, and are
+// evicted like newly set ones if the cache grows past its max size. Items
+// which expired since the snapshot was taken are restored as expired items.
+// On error, the items read so far stay in the cache.
+func (c *Cache) RestoreFrom(r io.Reader) error {
+	sr := &snapshotReader{r: bufio.NewReader(r)}
+	if magic := sr.raw(len(snapshotMagic)); sr.err != nil || magic != snapshotMagic {
+		return ErrNotASnapshot
+	}
+	version := sr.uvarint()
+	if sr.err != nil {
+		return sr.err
+	} else if version == 0 || version > snapshotVersion {
+		return fmt.Errorf("ccache: unsupported snapshot version %d", version)
+	}
+
+	for {
+		if marker := sr.byte(); sr.err != nil || marker == 0 {
+			return sr.err
+		}
+		key := sr.string()
+		if version == 2 || version == 3 {
+			key = upgradeKey(key)
+		}
+		expires := sr.varint()
+		accCount := sr.varint()
+		frequency := accCount
+		if version >= 3 {
+			frequency = sr.varint()
+		}
+		createTS := sr.varint()
+		accessTs := sr.varint()
+		info := ReqInfo{TimeEntered: time.Unix(0, sr.varint())}
+		info.ReqSize = sr.float()
+		info.MissingSize = sr.float()
+		data := sr.bytes()
+		if sr.err != nil {
+			return sr.err
+		}
+		value, err := c.codec.Decode(data)
+		if err != nil {
+			return fmt.Errorf("ccache: decoding %q: %w", key, err)
+		}
+
+		item := c.newItem(key, value, &info, expires)
+		item.accCount = accCount
+		item.created = toMonotonic(time.Unix(0, createTS))
+		item.accessed = toMonotonic(time.Unix(0, accessTs))
+		c.restore(item, frequency)
+	}
+}
+
+// The key of a version 2 or 3 snapshot in the current format. Their page keys
+// were 17 bytes: a 0 byte, then the backend and the uri, big endian.
+func upgradeKey(key string) string {
+	if len(key) != 17 || key[0] != 0 {
+		return key
+	}
+	var backend, uri uint64
+	for i := 1; i <= 8; i++ {
+		backend = backend<<8 | uint64(key[i])
+		uri = uri<<8 | uint64(key[i+8])
+	}
+	return buildKey(backend, uri)
+}
+
+func (c *Cache) restore(item *Item, frequency int64) {
+	atomic.AddUint64(&c.counter, 1)
+	existing, ok := c.bucket(item.key).restore(item, frequency)
+	for !ok {
+		// resharded in the meantime
+		existing, ok = c.bucket(item.key).restore(item, frequency)
+	}
+	if existing != nil {
+		c.afterDelete(existing, RemovedReplaced, 0)
+	}
+	c.introduce(item)
+}
+
+// Writes the snapshot encoding, remembering the first error
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (w *snapshotWriter) byte(b byte) {
+	if w.err == nil {
+		w.err = w.w.WriteByte(b)
+	}
+}
+
+func (w *snapshotWriter) uvarint(n uint64) {
+	if w.err == nil {
+		_, w.err = w.w.Write(w.buf[:binary.PutUvarint(w.buf[:], n)])
+	}
+}
+
+func (w *snapshotWriter) varint(n int64) {
+	if w.err == nil {
+		_, w.err = w.w.Write(w.buf[:binary.PutVarint(w.buf[:], n)])
+	}
+}
+
+func (w *snapshotWriter) float(f float64) {
+	w.uvarint(math.Float64bits(f))
+}
+
+func (w *snapshotWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.raw(s)
+}
+
+func (w *snapshotWriter) raw(s string) {
+	if w.err == nil {
+		_, w.err = w.w.WriteString(s)
+	}
+}
+
+func (w *snapshotWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+// Reads the snapshot encoding, remembering the first error. A snapshot which
+// ends in the middle of a record is reported as io.ErrUnexpectedEOF.
+type snapshotReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (r *snapshotReader) fail(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	r.err = err
+}
+
+func (r *snapshotReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	b, err := r.r.ReadByte()
+	if err != nil {
+		r.fail(err)
+	}
+	return b
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		r.fail(err)
+	}
+	return n
+}
+
+func (r *snapshotReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	n, err := binary.ReadVarint(r.r)
+	if err != nil {
+		r.fail(err)
+	}
+	return n
+}
+
+func (r *snapshotReader) float() float64 {
+	return math.Float64frombits(r.uvarint())
+}
+
+func (r *snapshotReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	// read through a LimitReader rather than allocating n bytes upfront, in
+	// case n is garbage
+	b, err := io.ReadAll(io.LimitReader(r.r, int64(n)))
+	if err == nil && uint64(len(b)) != n {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.fail(err)
+		return nil
+	}
+	return b
+}
+
+func (r *snapshotReader) raw(n int) string {
+	if r.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		r.fail(err)
+	}
+	return string(b)
+}
+
+func (r *snapshotReader) string() string {
+	return string(r.bytes())
+}
@@ -0,0 +1,225 @@
+package ccache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type SnapshotTests struct{}
+
+func Test_Snapshot(t *testing.T) {
+	Expectify(new(SnapshotTests), t)
+}
+
+func (_ SnapshotTests) RestoresItemsAndTheirMetadata() {
+	cache := New(Configure())
+	info := &ReqInfo{time.Unix(1000, 5), 33.5, 12.25}
+	cache.SetWithInfo("spice", "flow", info, time.Minute)
+	cache.Set("worm", 9, -time.Minute)
+	cache.Get("spice")
+	cache.Get("spice")
+
+	var buf bytes.Buffer
+	Expect(cache.Snapshot(&buf)).To.Equal(nil)
+	restored := New(Configure())
+	Expect(restored.RestoreFrom(&buf)).To.Equal(nil)
+	Expect(restored.size).To.Equal(int64(2))
+
+	for _, key := range []string{"spice", "worm"} {
+		original, item := cache.bucket(key).peek(key), restored.bucket(key).peek(key)
+		Expect(item.Value()).To.Equal(original.Value())
+		Expect(item.Expires()).To.Equal(original.Expires())
+		Expect(item.AccessCount()).To.Equal(original.AccessCount())
+		Expect(item.Created().UnixNano()).To.Equal(original.Created().UnixNano())
+		Expect(item.Accessed().UnixNano()).To.Equal(original.Accessed().UnixNano())
+		Expect(item.ReqInfo().TimeEntered.UnixNano()).To.Equal(original.ReqInfo().TimeEntered.UnixNano())
+		Expect(item.ReqInfo().ReqSize).To.Equal(original.ReqInfo().ReqSize)
+		Expect(item.ReqInfo().MissingSize).To.Equal(original.ReqInfo().MissingSize)
+	}
+	Expect(restored.Get("spice").AccessCount()).To.Equal(int64(3))
+	Expect(restored.Get("worm").Expired()).To.Equal(true)
+}
+
+func (_ SnapshotTests) KeepsTheAgedFrequencies() {
+	cache := New(Configure().FrequencyHalfLife(time.Hour))
+	item, _ := cache.set("spice", "flow", getDefaultReqInfo("flow"), time.Minute)
+	item.accCount = 16
+	// two half-lives since it was last fetched
+	item.freq = (cache.aging.period()-2)<<frequencyBits | 16
+	Expect(item.Frequency()).To.Equal(int64(4))
+
+	var buf bytes.Buffer
+	Expect(cache.Snapshot(&buf)).To.Equal(nil)
+	restored := New(Configure().FrequencyHalfLife(time.Hour))
+	Expect(restored.RestoreFrom(&buf)).To.Equal(nil)
+	item = restored.bucket("spice").peek("spice")
+	Expect(item.Frequency()).To.Equal(int64(4))
+	Expect(item.AccessCount()).To.Equal(int64(16))
+}
+
+func (_ SnapshotTests) RestoreReplacesExistingItems() {
+	cache := New(Configure())
+	cache.Set("spice", "flow", time.Minute)
+	var buf bytes.Buffer
+	cache.Snapshot(&buf)
+
+	deleted := ""
+	restored := New(Configure().OnDelete(func(item *Item) { deleted = item.Value().(string) }))
+	restored.Set("spice", "must", time.Minute)
+	Expect(restored.RestoreFrom(&buf)).To.Equal(nil)
+	Expect(restored.Get("spice").Value()).To.Equal("flow")
+	Expect(deleted).To.Equal("must")
+	Expect(restored.size).To.Equal(int64(1))
+}
+
+func (_ SnapshotTests) RestoreEvictsPastTheMaxSize() {
+	cache := New(Configure())
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	var buf bytes.Buffer
+	cache.Snapshot(&buf)
+	restored := New(Configure().MaxSize(10).ItemsToPrune(1))
+	Expect(restored.RestoreFrom(&buf)).To.Equal(nil)
+	Expect(restored.size).To.Equal(int64(10))
+}
+
+func (_ SnapshotTests) UsesTheConfiguredCodec() {
+	config := Configure().Codec(jsonCodec{})
+	cache := New(config)
+	cache.Set("spice", map[string]interface{}{"flow": "must"}, time.Minute)
+	var buf bytes.Buffer
+	Expect(cache.Snapshot(&buf)).To.Equal(nil)
+	Expect(bytes.Contains(buf.Bytes(), []byte(`{"flow":"must"}`))).To.Equal(true)
+
+	restored := New(config)
+	Expect(restored.RestoreFrom(&buf)).To.Equal(nil)
+	Expect(restored.Get("spice").Value().(map[string]interface{})["flow"]).To.Equal("must")
+}
+
+func (_ SnapshotTests) ReportsCodecErrors() {
+	cache := New(Configure().Codec(failingCodec{}))
+	cache.Set("spice", "flow", time.Minute)
+	err := cache.Snapshot(io.Discard)
+	Expect(err.Error()).To.Equal(`ccache: encoding "spice": no spice`)
+}
+
+func (_ SnapshotTests) UpgradesVersion1PageKeys() {
+	var buf bytes.Buffer
+	sw := &snapshotWriter{w: bufio.NewWriter(&buf)}
+	sw.raw(snapshotMagic)
+	sw.uvarint(1)
+	for _, key := range []string{"3:4", "spice", "3:flow"} {
+		value, _ := GobCodec{}.Encode(key)
+		sw.byte(1)
+		sw.string(key)
+		sw.varint(time.Now().Add(time.Minute).UnixNano())
+		for i := 0; i < 4; i++ {
+			sw.varint(0)
+		}
+		sw.float(0)
+		sw.float(0)
+		sw.bytes(value)
+	}
+	sw.byte(0)
+	sw.w.Flush()
+
+	cache := New(Configure())
+	Expect(cache.RestoreFrom(&buf)).To.Equal(nil)
+	page := []*Request{{Backend: 3, Uri: 4}}
+	cache.GetPage(page)
+	Expect(page[0].Obj).To.Equal("3:4")
+	Expect(cache.Get("spice").Value()).To.Equal("spice")
+	Expect(cache.Get("3:flow").Value()).To.Equal("3:flow")
+}
+
+func (_ SnapshotTests) UpgradesBinaryPageKeys() {
+	var buf bytes.Buffer
+	sw := &snapshotWriter{w: bufio.NewWriter(&buf)}
+	sw.raw(snapshotMagic)
+	sw.uvarint(3)
+	for _, key := range []string{"\x00\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x00\x00\x00\x00\x00\x04", "spice"} {
+		value, _ := GobCodec{}.Encode(key)
+		sw.byte(1)
+		sw.string(key)
+		sw.varint(time.Now().Add(time.Minute).UnixNano())
+		for i := 0; i < 5; i++ {
+			sw.varint(0)
+		}
+		sw.float(0)
+		sw.float(0)
+		sw.bytes(value)
+	}
+	sw.byte(0)
+	sw.w.Flush()
+
+	cache := New(Configure())
+	Expect(cache.RestoreFrom(&buf)).To.Equal(nil)
+	Expect(cache.Get("3:4") != nil).To.Equal(true)
+	Expect(cache.Get("spice").Value()).To.Equal("spice")
+}
+
+func (_ SnapshotTests) RejectsInvalidSnapshots() {
+	cache := New(Configure())
+	Expect(cache.RestoreFrom(bytes.NewBufferString("not a snapshot at all"))).To.Equal(ErrNotASnapshot)
+	Expect(cache.RestoreFrom(bytes.NewBufferString(snapshotMagic + "\x05")).Error()).To.Equal("ccache: unsupported snapshot version 5")
+
+	cache.Set("spice", "flow", time.Minute)
+	var buf bytes.Buffer
+	cache.Snapshot(&buf)
+	truncated := buf.Bytes()[:buf.Len()-3]
+	Expect(New(Configure()).RestoreFrom(bytes.NewReader(truncated))).To.Equal(io.ErrUnexpectedEOF)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Decode(data []byte) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+func (_ SnapshotTests) WritesWithoutHoldingUpReshard() {
+	cache := New(Configure())
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	var buf bytes.Buffer
+	w := writerFunc(func(p []byte) (int, error) {
+		Expect(cache.Reshard(32)).To.Equal(nil)
+		return buf.Write(p)
+	})
+	Expect(cache.Snapshot(w)).To.Equal(nil)
+
+	restored := New(Configure())
+	Expect(restored.RestoreFrom(&buf)).To.Equal(nil)
+	checkSize(restored, 10)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+type failingCodec struct{}
+
+func (failingCodec) Encode(value interface{}) ([]byte, error) {
+	return nil, errors.New("no spice")
+}
+
+func (failingCodec) Decode(data []byte) (interface{}, error) {
+	return nil, errors.New("no spice")
+}
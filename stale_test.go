@@ -0,0 +1,75 @@
+package ccache
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type StaleTests struct{}
+
+func Test_Stale(t *testing.T) {
+	Expectify(new(StaleTests), t)
+}
+
+func (_ StaleTests) ReturnsFreshItems() {
+	cache := New(Configure())
+	cache.Set("spice", "flow", time.Minute)
+	item, _ := cache.FetchStale("spice", time.Minute, time.Second, failingFetch)
+	Expect(item.Value()).To.Equal("flow")
+}
+
+func (_ StaleTests) ReturnsStaleItemsWithinTheGraceWindow() {
+	cache := New(Configure())
+	cache.Set("spice", "flow", -time.Millisecond)
+	loads := int32(0)
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(time.Millisecond * 10)
+		return "must", nil
+	}
+	for i := 0; i < 5; i++ {
+		item, err := cache.FetchStale("spice", time.Minute, time.Second, fetch)
+		Expect(err).To.Equal(nil)
+		Expect(item.Value()).To.Equal("flow")
+	}
+	time.Sleep(time.Millisecond * 30)
+	Expect(atomic.LoadInt32(&loads)).To.Equal(int32(1))
+	Expect(cache.Get("spice").Value()).To.Equal("must")
+	Expect(cache.Get("spice").Expired()).To.Equal(false)
+}
+
+func (_ StaleTests) BlocksBeyondTheGraceWindow() {
+	cache := New(Configure())
+	cache.Set("spice", "flow", -time.Minute)
+	item, _ := cache.FetchStale("spice", time.Minute, time.Second, func() (interface{}, error) { return "must", nil })
+	Expect(item.Value()).To.Equal("must")
+}
+
+func (_ StaleTests) BlocksOnMisses() {
+	cache := New(Configure())
+	item, _ := cache.FetchStale("spice", time.Minute, time.Second, func() (interface{}, error) { return "must", nil })
+	Expect(item.Value()).To.Equal("must")
+	_, err := cache.FetchStale("worm", time.Minute, time.Second, failingFetch)
+	Expect(err.Error()).To.Equal("no spice")
+}
+
+func (_ StaleTests) KeepsTheStaleItemWhenTheRefreshFails() {
+	reported := make(chan string, 1)
+	cache := New(Configure().OnRefreshError(func(key string, err error) {
+		reported <- key + " " + err.Error()
+	}))
+	cache.Set("spice", "flow", -time.Millisecond)
+	item, err := cache.FetchStale("spice", time.Minute, time.Second, failingFetch)
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("flow")
+	Expect(<-reported).To.Equal("spice no spice")
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+}
+
+func failingFetch() (interface{}, error) {
+	return nil, errors.New("no spice")
+}
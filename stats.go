@@ -0,0 +1,311 @@
+package ccache
+
+import "sync/atomic"
+
+type EvictionReason int
+
+const (
+	// The item was picked by the evaluator to make room
+	EvictedForSpace EvictionReason = iota
+	// The item was picked by the evaluator and had already expired
+	EvictedExpired
+	// The item was evicted along with another object of its page, with
+	// PageEviction
+	EvictedWithPage
+	// The item was evicted because its backend was over the hard cap of its
+	// quota, see BackendQuota
+	EvictedOverQuota
+	evictionReasons
+)
+
+// The removal of an evicted item
+func (r EvictionReason) removal() RemovalReason {
+	if r == EvictedExpired {
+		return RemovedExpired
+	}
+	return RemovedEvicted
+}
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictedForSpace:
+		return "space"
+	case EvictedExpired:
+		return "expired"
+	case EvictedWithPage:
+		return "page"
+	case EvictedOverQuota:
+		return "quota"
+	}
+	return "unknown"
+}
+
+// Why an item left the cache, as given to the OnEvict callback
+type RemovalReason int
+
+const (
+	// The item was evicted to make room: for space, along with its page or
+	// for its backend's quota
+	RemovedEvicted RemovalReason = iota
+	// The item had expired, and was evicted or swept
+	RemovedExpired
+	// The item was replaced by a set of its key
+	RemovedReplaced
+	// The item was deleted by Delete, DeleteAll or DeleteBackend
+	RemovedDeleted
+	// The item was removed by Clear
+	RemovedCleared
+)
+
+func (r RemovalReason) String() string {
+	switch r {
+	case RemovedEvicted:
+		return "evicted"
+	case RemovedExpired:
+		return "expired"
+	case RemovedReplaced:
+		return "replaced"
+	case RemovedDeleted:
+		return "deleted"
+	case RemovedCleared:
+		return "cleared"
+	}
+	return "unknown"
+}
+
+// Counters for the operations on a single bucket. Every field is updated
+// atomically.
+type counters struct {
+	hits          uint64
+	misses        uint64
+	expiredHits   uint64
+	sets          uint64
+	deletes       uint64
+	notAdmitted   uint64
+	notReplaced   uint64
+	bytesHit      uint64
+	bytesAdmitted uint64
+	bytesEvicted  uint64
+	evictions     [evictionReasons]uint64
+}
+
+func (c *counters) hit(item *Item) {
+	if item.Expired() {
+		atomic.AddUint64(&c.expiredHits, 1)
+		return
+	}
+	atomic.AddUint64(&c.hits, 1)
+	atomic.AddUint64(&c.bytesHit, uint64(item.size))
+}
+
+func (c *counters) miss() {
+	atomic.AddUint64(&c.misses, 1)
+}
+
+func (c *counters) set(item *Item) {
+	atomic.AddUint64(&c.sets, 1)
+	atomic.AddUint64(&c.bytesAdmitted, uint64(item.size))
+}
+
+func (c *counters) delete() {
+	atomic.AddUint64(&c.deletes, 1)
+}
+
+func (c *counters) reject() {
+	atomic.AddUint64(&c.notAdmitted, 1)
+}
+
+func (c *counters) keep() {
+	atomic.AddUint64(&c.notReplaced, 1)
+}
+
+func (c *counters) evict(item *Item, reason EvictionReason) {
+	atomic.AddUint64(&c.evictions[reason], 1)
+	atomic.AddUint64(&c.bytesEvicted, uint64(item.size))
+}
+
+func (c *counters) snapshot() BucketStats {
+	s := BucketStats{
+		Hits:          atomic.LoadUint64(&c.hits),
+		Misses:        atomic.LoadUint64(&c.misses),
+		ExpiredHits:   atomic.LoadUint64(&c.expiredHits),
+		Sets:          atomic.LoadUint64(&c.sets),
+		Deletes:       atomic.LoadUint64(&c.deletes),
+		NotAdmitted:   atomic.LoadUint64(&c.notAdmitted),
+		NotReplaced:   atomic.LoadUint64(&c.notReplaced),
+		BytesHit:      atomic.LoadUint64(&c.bytesHit),
+		BytesAdmitted: atomic.LoadUint64(&c.bytesAdmitted),
+		BytesEvicted:  atomic.LoadUint64(&c.bytesEvicted),
+		Evictions:     make(map[EvictionReason]uint64, evictionReasons),
+	}
+	for reason := range c.evictions {
+		s.Evictions[EvictionReason(reason)] = atomic.LoadUint64(&c.evictions[reason])
+	}
+	return s
+}
+
+// Adds o's counts
+func (c *counters) add(o *counters) {
+	atomic.AddUint64(&c.hits, atomic.LoadUint64(&o.hits))
+	atomic.AddUint64(&c.misses, atomic.LoadUint64(&o.misses))
+	atomic.AddUint64(&c.expiredHits, atomic.LoadUint64(&o.expiredHits))
+	atomic.AddUint64(&c.sets, atomic.LoadUint64(&o.sets))
+	atomic.AddUint64(&c.deletes, atomic.LoadUint64(&o.deletes))
+	atomic.AddUint64(&c.notAdmitted, atomic.LoadUint64(&o.notAdmitted))
+	atomic.AddUint64(&c.notReplaced, atomic.LoadUint64(&o.notReplaced))
+	atomic.AddUint64(&c.bytesHit, atomic.LoadUint64(&o.bytesHit))
+	atomic.AddUint64(&c.bytesAdmitted, atomic.LoadUint64(&o.bytesAdmitted))
+	atomic.AddUint64(&c.bytesEvicted, atomic.LoadUint64(&o.bytesEvicted))
+	for reason := range c.evictions {
+		atomic.AddUint64(&c.evictions[reason], atomic.LoadUint64(&o.evictions[reason]))
+	}
+}
+
+// Counters for GetPage and SetPageWithMissingSize, kept per cache
+type pageCounters struct {
+	pageHits        uint64
+	partialPageHits uint64
+	pageMisses      uint64
+	rejections      uint64
+	bytesRejected   uint64
+}
+
+func (c *pageCounters) page(hits, total int) {
+	if total == 0 {
+		return
+	}
+	if hits == total {
+		atomic.AddUint64(&c.pageHits, 1)
+	} else if hits > 0 {
+		atomic.AddUint64(&c.partialPageHits, 1)
+	} else {
+		atomic.AddUint64(&c.pageMisses, 1)
+	}
+}
+
+func (c *pageCounters) reject(missingSize float64) {
+	atomic.AddUint64(&c.rejections, 1)
+	atomic.AddUint64(&c.bytesRejected, uint64(missingSize))
+}
+
+// A snapshot of the counters of a bucket, or the sum over every bucket
+type BucketStats struct {
+	Hits          uint64 // gets which found a live item
+	Misses        uint64 // gets which found nothing
+	ExpiredHits   uint64 // gets which found an expired item
+	Sets          uint64
+	Deletes       uint64
+	NotAdmitted   uint64 // sets refused by the TinyLFU filter
+	NotReplaced   uint64 // sets which left a tracked item in place, with Track
+	BytesHit      uint64 // size of the live items found by gets
+	BytesAdmitted uint64 // size of the items set
+	BytesEvicted  uint64
+	Evictions     map[EvictionReason]uint64
+}
+
+func (s *BucketStats) add(o BucketStats) {
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.ExpiredHits += o.ExpiredHits
+	s.Sets += o.Sets
+	s.Deletes += o.Deletes
+	s.NotAdmitted += o.NotAdmitted
+	s.NotReplaced += o.NotReplaced
+	s.BytesHit += o.BytesHit
+	s.BytesAdmitted += o.BytesAdmitted
+	s.BytesEvicted += o.BytesEvicted
+	for reason, count := range o.Evictions {
+		s.Evictions[reason] += count
+	}
+}
+
+// The total number of evictions, whatever the reason
+func (s BucketStats) TotalEvictions() uint64 {
+	total := uint64(0)
+	for _, count := range s.Evictions {
+		total += count
+	}
+	return total
+}
+
+// Live hits over all gets. Expired hits count as misses.
+func (s BucketStats) HitRatio() float64 {
+	return ratio(s.Hits, s.Hits+s.Misses+s.ExpiredHits)
+}
+
+// A snapshot of the cache's counters
+type Stats struct {
+	BucketStats
+	Buckets         []BucketStats
+	PageHits        uint64                  // pages whose objects were all found live
+	PartialPageHits uint64                  // pages with some of their objects found live
+	PageMisses      uint64                  // pages with none of their objects found live
+	Rejections      uint64                  // pages refused by the admission policy or TinyLFU
+	BytesRejected   uint64                  // missing size of the refused pages
+	Backends        map[uint64]BackendUsage // usage of the backends which weren't deleted
+}
+
+// Bytes hit over bytes requested. This assumes read-through usage, where
+// every miss is followed by a set (or an admission rejection) of what was
+// missing.
+func (s Stats) ByteHitRatio() float64 {
+	return ratio(s.BytesHit, s.BytesHit+s.BytesAdmitted+s.BytesRejected)
+}
+
+// Fully hit pages over all pages
+func (s Stats) PageHitRatio() float64 {
+	return ratio(s.PageHits, s.PageHits+s.PartialPageHits+s.PageMisses)
+}
+
+// Returns a snapshot of the cache's statistics. Counters are read one at a
+// time, so a snapshot taken under load isn't perfectly consistent.
+// Buckets only lists the current buckets, while the totals also include the
+// buckets replaced by Reshard.
+func (c *Cache) Stats() Stats {
+	t := c.table()
+	s := newStats(&c.pages, len(t.buckets))
+	for i, bucket := range t.buckets {
+		s.Buckets[i] = bucket.stats.snapshot()
+		// moved buckets are counted in retired
+		if !bucket.isMoved() {
+			s.add(s.Buckets[i])
+		}
+	}
+	if m := c.migrating(); m != nil && m.from == t {
+		for _, bucket := range m.to.buckets {
+			s.add(bucket.stats.snapshot())
+		}
+	}
+	s.add(c.retired.snapshot())
+	s.Backends = c.backends.snapshot(c.capacity())
+	return s
+}
+
+func newStats(pages *pageCounters, buckets int) Stats {
+	s := Stats{
+		BucketStats: BucketStats{
+			Evictions: make(map[EvictionReason]uint64, evictionReasons),
+		},
+		Buckets: make([]BucketStats, buckets),
+	}
+	if pages != nil {
+		s.PageHits = atomic.LoadUint64(&pages.pageHits)
+		s.PartialPageHits = atomic.LoadUint64(&pages.partialPageHits)
+		s.PageMisses = atomic.LoadUint64(&pages.pageMisses)
+		s.Rejections = atomic.LoadUint64(&pages.rejections)
+		s.BytesRejected = atomic.LoadUint64(&pages.bytesRejected)
+	}
+	return s
+}
+
+func (s *Stats) addBucket(i int, c *counters) {
+	s.Buckets[i] = c.snapshot()
+	s.add(s.Buckets[i])
+}
+
+func ratio(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
@@ -0,0 +1,120 @@
+package ccache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type StatsTests struct{}
+
+func Test_Stats(t *testing.T) {
+	Expectify(new(StatsTests), t)
+}
+
+func (_ StatsTests) CountsGetsSetsAndDeletes() {
+	cache := New(Configure())
+	cache.Set("spice", &SizedItem{0, 3}, time.Minute)
+	cache.Set("worm", &SizedItem{0, 2}, time.Second*-1)
+	cache.Get("spice")
+	cache.Get("spice")
+	cache.Get("worm")
+	cache.Get("sand")
+	cache.Delete("spice")
+	cache.Delete("spice")
+
+	stats := cache.Stats()
+	Expect(stats.Hits).To.Equal(uint64(2))
+	Expect(stats.ExpiredHits).To.Equal(uint64(1))
+	Expect(stats.Misses).To.Equal(uint64(1))
+	Expect(stats.Sets).To.Equal(uint64(2))
+	Expect(stats.Deletes).To.Equal(uint64(1))
+	Expect(stats.BytesHit).To.Equal(uint64(6))
+	Expect(stats.BytesAdmitted).To.Equal(uint64(5))
+	Expect(stats.HitRatio()).To.Equal(0.5)
+}
+
+func (_ StatsTests) SumsTheBuckets() {
+	cache := New(Configure())
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+		cache.Get(strconv.Itoa(i))
+	}
+	stats := cache.Stats()
+	Expect(len(stats.Buckets)).To.Equal(16)
+	hits := uint64(0)
+	for _, bucket := range stats.Buckets {
+		hits += bucket.Hits
+	}
+	Expect(hits).To.Equal(uint64(100))
+	Expect(stats.Hits).To.Equal(uint64(100))
+}
+
+func (_ StatsTests) CountsEvictions() {
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1))
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	stats := cache.Stats()
+	Expect(stats.TotalEvictions()).To.Equal(uint64(5))
+	Expect(stats.Evictions[EvictedForSpace]).To.Equal(uint64(5))
+	Expect(stats.Evictions[EvictedExpired]).To.Equal(uint64(0))
+	Expect(stats.BytesEvicted).To.Equal(uint64(5))
+}
+
+func (_ StatsTests) CountsExpiredEvictions() {
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1))
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, -time.Minute)
+	}
+	stats := cache.Stats()
+	Expect(stats.Evictions[EvictedExpired]).To.Equal(uint64(5))
+}
+
+func (_ StatsTests) CountsPages() {
+	cache := New(Configure())
+	cache.SetPage([]*Request{{1, 1, "a"}, {1, 2, "b"}}, time.Minute)
+
+	cache.GetPage([]*Request{{Backend: 1, Uri: 1}, {Backend: 1, Uri: 2}})
+	cache.GetPage([]*Request{{Backend: 1, Uri: 1}, {Backend: 1, Uri: 3}})
+	cache.GetPage([]*Request{{Backend: 2, Uri: 1}})
+	cache.GetPage([]*Request{{Backend: 1, Uri: 2}})
+	cache.GetPage(nil)
+
+	stats := cache.Stats()
+	Expect(stats.PageHits).To.Equal(uint64(2))
+	Expect(stats.PartialPageHits).To.Equal(uint64(1))
+	Expect(stats.PageMisses).To.Equal(uint64(1))
+	Expect(stats.PageHitRatio()).To.Equal(0.5)
+	Expect(stats.Hits).To.Equal(uint64(4))
+	Expect(stats.Misses).To.Equal(uint64(2))
+}
+
+func (_ StatsTests) CountsExpiredObjectsAsPageMisses() {
+	cache := New(Configure())
+	cache.SetPage([]*Request{{1, 1, "a"}}, time.Minute)
+	cache.SetPage([]*Request{{1, 2, "b"}}, -time.Minute)
+
+	reqs := []*Request{{Backend: 1, Uri: 1}, {Backend: 1, Uri: 2}}
+	cache.GetPage(reqs)
+	cache.GetPage([]*Request{{Backend: 1, Uri: 2}})
+
+	Expect(reqs[1].Obj).To.Equal("b")
+	stats := cache.Stats()
+	Expect(stats.PageHits).To.Equal(uint64(0))
+	Expect(stats.PartialPageHits).To.Equal(uint64(1))
+	Expect(stats.PageMisses).To.Equal(uint64(1))
+	Expect(stats.ExpiredHits).To.Equal(uint64(2))
+}
+
+func (_ StatsTests) CountsAdmissionRejections() {
+	cache := New(Configure().MaxSize(10).AdmissionPolicy(true).AdmissionThres(5))
+	cache.SetPageWithMissingSize([]*Request{{1, 1, &SizedItem{0, 6}}}, 6, time.Minute)
+	cache.SetPageWithMissingSize([]*Request{{1, 2, &SizedItem{0, 6}}}, 6, time.Minute)
+	stats := cache.Stats()
+	Expect(stats.Sets).To.Equal(uint64(1))
+	Expect(stats.Rejections).To.Equal(uint64(1))
+	Expect(stats.BytesRejected).To.Equal(uint64(6))
+}
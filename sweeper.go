@@ -0,0 +1,64 @@
+package ccache
+
+import "time"
+
+// Where the sweeper left off, passes resume from there
+type sweeper struct {
+	bucket   int
+	position int
+}
+
+func (c *Cache) sweep(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(c.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sweepPass(c.sweepBudget)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Walks up to budget items, bucket after bucket, and removes the expired ones.
+// Returns the number of items removed.
+func (c *Cache) sweepPass(budget int) int {
+	now := time.Now().UnixNano()
+	removed := 0
+	s := &c.sweeper
+	t := c.table()
+	// the bucket count may have changed since the last pass
+	s.bucket &= int(t.mask)
+	for visited := 0; budget > 0 && visited <= len(t.buckets); {
+		bucket := t.buckets[s.bucket]
+		expired, looked := bucket.expired(s.position, budget, now)
+		if bucket.isMoved() {
+			// its items are swept in their new buckets
+			expired, looked = nil, 0
+		}
+		budget -= looked
+		deleted := 0
+		for _, item := range expired {
+			if c.deleteItem(bucket, item, RemovedExpired, 0) {
+				bucket.stats.evict(item, EvictedExpired)
+				if c.observer != nil {
+					c.observer.OnEvict(item)
+				}
+				deleted++
+			}
+		}
+		// removals move the bucket's last item in the freed slot, don't skip
+		// it. Expired items which were replaced in the meantime weren't
+		// removed, their slots still hold the new items.
+		s.position += looked - deleted
+		removed += deleted
+		if looked == 0 {
+			s.bucket = (s.bucket + 1) & int(t.mask)
+			s.position = 0
+			visited++
+		}
+	}
+	return removed
+}
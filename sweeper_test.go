@@ -0,0 +1,91 @@
+package ccache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type SweeperTests struct{}
+
+func Test_Sweeper(t *testing.T) {
+	Expectify(new(SweeperTests), t)
+}
+
+func (_ SweeperTests) RemovesExpiredItems() {
+	deleted := 0
+	cache := New(Configure().OnDelete(func(item *Item) { deleted++ }))
+	for i := 0; i < 10; i++ {
+		cache.Set("live"+strconv.Itoa(i), i, time.Minute)
+		cache.Set("dead"+strconv.Itoa(i), i, -time.Minute)
+	}
+	Expect(cache.sweepPass(100)).To.Equal(10)
+	Expect(deleted).To.Equal(10)
+	checkSize(cache, 10)
+	Expect(cache.Get("dead0")).To.Equal(nil)
+	Expect(cache.Get("live0").Value()).To.Equal(0)
+	Expect(cache.Stats().Evictions[EvictedExpired]).To.Equal(uint64(10))
+}
+
+func (_ SweeperTests) RespectsTheBudget() {
+	cache := New(Configure().Buckets(1))
+	for i := 0; i < 20; i++ {
+		cache.Set(strconv.Itoa(i), i, -time.Minute)
+	}
+	Expect(cache.sweepPass(5)).To.Equal(5)
+	Expect(cache.sweepPass(10)).To.Equal(10)
+	Expect(cache.sweepPass(10)).To.Equal(5)
+	checkSize(cache, 0)
+}
+
+func (_ SweeperTests) ResumesWhereItLeftOff() {
+	cache := New(Configure().Buckets(1))
+	for i := 0; i < 10; i++ {
+		cache.Set("live"+strconv.Itoa(i), i, time.Minute)
+	}
+	cache.Set("dead", 0, -time.Minute)
+	Expect(cache.sweepPass(5)).To.Equal(0)
+	Expect(cache.sweepPass(5)).To.Equal(0)
+	Expect(cache.sweepPass(5)).To.Equal(1)
+}
+
+func (_ SweeperTests) RunsInTheBackground() {
+	cache := New(Configure().SweepInterval(time.Millisecond * 5))
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Millisecond*10)
+	}
+	time.Sleep(time.Millisecond * 50)
+	cache.Stop()
+	Expect(cache.size).To.Equal(int64(0))
+	cache.Stop()
+}
+
+func (_ SweeperTests) IsDisabledByDefault() {
+	cache := New(Configure())
+	Expect(cache.donec == nil).To.Equal(true)
+	cache.Stop()
+}
+
+func (_ SweeperTests) StopsAndRestartsConcurrently() {
+	cache := New(Configure().SweepInterval(time.Millisecond))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if (i+j)%2 == 0 {
+					cache.Stop()
+				} else {
+					cache.restart()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	cache.Stop()
+	Expect(cache.donec == nil).To.Equal(true)
+}
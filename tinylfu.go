@@ -0,0 +1,158 @@
+package ccache
+
+import "sync/atomic"
+
+// The number of rows of the count-min sketch, each indexed by its own hash
+const sketchDepth = 4
+
+// The highest count a sketch counter can reach
+const sketchMax = 15
+
+// The 4 bit counters are packed 16 to a uint64
+const (
+	countersPerWord = 16
+	// every counter of a word halved, once the word is shifted right by 1
+	halvedCounters = 0x7777777777777777
+)
+
+// tinyLFU estimates how often keys are accessed, to decide whether a new key
+// is worth evicting an existing one for. Counts are kept in a count-min sketch
+// of 4 bit counters which are all halved every sampleSize increments, so that
+// old popularity fades. A doorkeeper bloom filter absorbs the first access of
+// every key, keeping one-hit wonders out of the sketch.
+//
+// Every get goes through the filter, so it takes no lock: counters and
+// doorkeeper bits are updated with atomic compare and swaps. Increments which
+// race with a halving may be lost, which an estimate can afford.
+type tinyLFU struct {
+	counters   []uint64
+	doorkeeper []uint64
+	mask       uint64
+	additions  int64
+	sampleSize int64
+}
+
+// Creates a filter tracking about width keys
+func newTinyLFU(width int) *tinyLFU {
+	size := 1
+	for size < width {
+		size <<= 1
+	}
+	return &tinyLFU{
+		counters:   make([]uint64, (size*sketchDepth+countersPerWord-1)/countersPerWord),
+		doorkeeper: make([]uint64, (size+63)/64),
+		mask:       uint64(size - 1),
+		sampleSize: int64(size) * 10,
+	}
+}
+
+// Records an access to the key whose hash is h
+func (t *tinyLFU) increment(h uint64) {
+	if t.admitDoorkeeper(h) {
+		for i := uint64(0); i < sketchDepth; i++ {
+			t.incrementCounter(t.index(h, i))
+		}
+	}
+	// only the increment reaching sampleSize resets, and the reset brings
+	// additions back under it
+	if atomic.AddInt64(&t.additions, 1) == t.sampleSize {
+		t.reset()
+	}
+}
+
+func (t *tinyLFU) incrementCounter(idx uint64) {
+	word, shift := &t.counters[idx/countersPerWord], idx%countersPerWord*4
+	for {
+		old := atomic.LoadUint64(word)
+		if old>>shift&sketchMax == sketchMax {
+			return
+		}
+		if atomic.CompareAndSwapUint64(word, old, old+1<<shift) {
+			return
+		}
+	}
+}
+
+func (t *tinyLFU) counter(idx uint64) uint64 {
+	return atomic.LoadUint64(&t.counters[idx/countersPerWord]) >> (idx % countersPerWord * 4) & sketchMax
+}
+
+// Returns the estimated number of recent accesses to the key whose hash is h
+func (t *tinyLFU) estimate(h uint64) int {
+	min := uint64(sketchMax)
+	for i := uint64(0); i < sketchDepth; i++ {
+		if c := t.counter(t.index(h, i)); c < min {
+			min = c
+		}
+	}
+	if t.inDoorkeeper(h) {
+		return int(min) + 1
+	}
+	return int(min)
+}
+
+// Adds h to the doorkeeper, returning true if it was already there
+func (t *tinyLFU) admitDoorkeeper(h uint64) bool {
+	if t.inDoorkeeper(h) {
+		return true
+	}
+	for _, bit := range t.doorkeeperBits(h) {
+		word := &t.doorkeeper[bit/64]
+		for {
+			old := atomic.LoadUint64(word)
+			if old&(1<<(bit%64)) != 0 || atomic.CompareAndSwapUint64(word, old, old|1<<(bit%64)) {
+				break
+			}
+		}
+	}
+	return false
+}
+
+func (t *tinyLFU) inDoorkeeper(h uint64) bool {
+	for _, bit := range t.doorkeeperBits(h) {
+		if atomic.LoadUint64(&t.doorkeeper[bit/64])&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *tinyLFU) doorkeeperBits(h uint64) [2]uint64 {
+	return [2]uint64{h & t.mask, (h >> 32) & t.mask}
+}
+
+// The counter of h in row i, picked by double hashing
+func (t *tinyLFU) index(h uint64, i uint64) uint64 {
+	h1, h2 := h, (h>>32)|1
+	return i*(t.mask+1) + (h1+i*h2)&t.mask
+}
+
+// Halves every counter and clears the doorkeeper
+func (t *tinyLFU) reset() {
+	for i := range t.counters {
+		for {
+			old := atomic.LoadUint64(&t.counters[i])
+			if atomic.CompareAndSwapUint64(&t.counters[i], old, old>>1&halvedCounters) {
+				break
+			}
+		}
+	}
+	for i := range t.doorkeeper {
+		atomic.StoreUint64(&t.doorkeeper[i], 0)
+	}
+	atomic.AddInt64(&t.additions, -t.sampleSize/2)
+}
+
+// The 64 bit FNV-1a hash of the key, mixed so that its upper half can serve
+// as a second hash
+func hashKey64(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,180 @@
+package ccache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type TinyLFUTests struct{}
+
+func Test_TinyLFU(t *testing.T) {
+	Expectify(new(TinyLFUTests), t)
+}
+
+func (_ TinyLFUTests) EstimatesAccessCounts() {
+	filter := newTinyLFU(1024)
+	for i := 0; i < 5; i++ {
+		filter.increment(hashKey64("spice"))
+	}
+	filter.increment(hashKey64("worm"))
+	Expect(filter.estimate(hashKey64("spice"))).To.Equal(5)
+	Expect(filter.estimate(hashKey64("worm"))).To.Equal(1)
+	Expect(filter.estimate(hashKey64("sand"))).To.Equal(0)
+}
+
+func (_ TinyLFUTests) CountsSaturate() {
+	filter := newTinyLFU(1024)
+	for i := 0; i < 100; i++ {
+		filter.increment(hashKey64("spice"))
+	}
+	Expect(filter.estimate(hashKey64("spice"))).To.Equal(sketchMax + 1)
+}
+
+func (_ TinyLFUTests) AgesCounts() {
+	filter := newTinyLFU(1024)
+	for i := 0; i < 9; i++ {
+		filter.increment(hashKey64("spice"))
+	}
+	// the doorkeeper took the first access, the sketch has 8 of them
+	Expect(filter.estimate(hashKey64("spice"))).To.Equal(9)
+	filter.reset()
+	Expect(filter.estimate(hashKey64("spice"))).To.Equal(4)
+}
+
+func (_ TinyLFUTests) ResetsEverySampleSizeIncrements() {
+	filter := newTinyLFU(16)
+	for i := int64(0); i < filter.sampleSize-1; i++ {
+		filter.increment(hashKey64("spice"))
+	}
+	Expect(filter.estimate(hashKey64("spice"))).To.Equal(sketchMax + 1)
+	filter.increment(hashKey64("spice"))
+	Expect(filter.estimate(hashKey64("spice"))).To.Equal(sketchMax / 2)
+	Expect(filter.additions).To.Equal(filter.sampleSize / 2)
+}
+
+func (_ TinyLFUTests) CountsConcurrentIncrements() {
+	filter := newTinyLFU(1024)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				filter.increment(hashKey64("spice"))
+				filter.estimate(hashKey64("spice"))
+			}
+		}()
+	}
+	wg.Wait()
+	Expect(filter.estimate(hashKey64("spice"))).To.Equal(sketchMax + 1)
+	Expect(filter.additions).To.Equal(int64(800))
+}
+
+func (_ TinyLFUTests) AdmitsEverythingWhileThereIsRoom() {
+	cache := New(Configure().MaxSize(10).TinyLFU(100))
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	Expect(cache.size).To.Equal(int64(10))
+	Expect(cache.Stats().NotAdmitted).To.Equal(uint64(0))
+}
+
+func (_ TinyLFUTests) RefusesKeysLessPopularThanTheVictim() {
+	cache := New(Configure().MaxSize(10).ItemsToPrune(1).TinyLFU(100))
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+		for j := 0; j < 3; j++ {
+			cache.Get(strconv.Itoa(i))
+		}
+	}
+	item, _ := cache.set("spice", "flow", getDefaultReqInfo("flow"), time.Minute)
+	Expect(item.Value()).To.Equal("flow")
+	Expect(cache.Get("spice")).To.Equal(nil)
+	Expect(cache.Stats().NotAdmitted).To.Equal(uint64(1))
+
+	// popular enough now
+	for j := 0; j < 5; j++ {
+		cache.Get("spice")
+	}
+	cache.Set("spice", "flow", time.Minute)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.size).To.Equal(int64(10))
+}
+
+func (_ TinyLFUTests) RefusesKeysLessPopularThanAnyVictim() {
+	for _, itemsToPrune := range []uint32{1, 2} {
+		cache := New(Configure().MaxSize(2).ItemsToPrune(itemsToPrune).EvictionPool(4).TinyLFU(100))
+		cache.Set("spice", "flow", time.Minute)
+		cache.Set("worm", "sand", time.Minute)
+		for i := 0; i < 5; i++ {
+			cache.Get("worm")
+		}
+		spice, worm := cache.bucket("spice").peek("spice"), cache.bucket("worm").peek("worm")
+		cache.pool.add(poolEntry{cache.bucketIndex("spice"), spice, 0})
+		cache.pool.add(poolEntry{cache.bucketIndex("worm"), worm, 5})
+
+		// more popular than spice, which is evicted first, but not than worm
+		for i := 0; i < 3; i++ {
+			cache.Get("melange")
+		}
+		cache.Set("melange", "gold", time.Minute)
+		Expect(cache.Get("melange") != nil).To.Equal(itemsToPrune == 1)
+	}
+}
+
+func (_ TinyLFUTests) AdmitsPagesByTheMemoryTheyTake() {
+	cache := New(Configure().MaxMemory(entryMemory(buildKey(1, 1), 1) + 10).ItemsToPrune(1).TinyLFU(100))
+	cache.SetPage(page(1, 1), time.Minute)
+	for i := 0; i < 3; i++ {
+		cache.GetPage(page(1, 1))
+	}
+
+	// the page's ReqSize would fit, its entries don't
+	cache.SetPage(page(2, 1, 2), time.Minute)
+	Expect(cache.Get(buildKey(2, 1))).To.Equal(nil)
+	Expect(cache.Stats().Rejections).To.Equal(uint64(1))
+	Expect(cache.Get(buildKey(1, 1)).Value()).To.Equal(1)
+}
+
+func (_ TinyLFUTests) AlwaysAdmitsReplacements() {
+	cache := New(Configure().MaxSize(2).ItemsToPrune(1).TinyLFU(100))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	cache.Set("spice", "must", time.Minute)
+	Expect(cache.Get("spice").Value()).To.Equal("must")
+}
+
+func (_ TinyLFUTests) FetchReturnsRefusedValues() {
+	cache := New(Configure().MaxSize(1).ItemsToPrune(1).TinyLFU(100))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Get("spice")
+	cache.Get("spice")
+	item, _ := cache.Fetch("worm", time.Minute, func() (interface{}, error) { return "sand", nil })
+	Expect(item.Value()).To.Equal("sand")
+	Expect(cache.Get("worm")).To.Equal(nil)
+}
+
+func (_ TinyLFUTests) AdmitsPagesAsAWhole() {
+	cache := New(Configure().MaxSize(4).ItemsToPrune(1).TinyLFU(100))
+	cache.SetPage(page(1, 1, 2, 3, 4), time.Minute)
+	for i := 0; i < 3; i++ {
+		cache.GetPage(page(1, 1, 2, 3, 4))
+	}
+
+	cache.SetPage(page(2, 1, 2), time.Minute)
+	Expect(cache.Get(buildKey(2, 1))).To.Equal(nil)
+	Expect(cache.Get(buildKey(2, 2))).To.Equal(nil)
+	Expect(cache.Stats().Rejections).To.Equal(uint64(1))
+
+	// one popular object doesn't make the page popular
+	for i := 0; i < 10; i++ {
+		cache.Get(buildKey(3, 1))
+	}
+	cache.SetPage(page(3, 1, 2), time.Minute)
+	Expect(cache.Get(buildKey(3, 1))).To.Equal(nil)
+	Expect(cache.Stats().Rejections).To.Equal(uint64(2))
+}
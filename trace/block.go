@@ -0,0 +1,83 @@
+package trace
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/karlseguin/ccache"
+)
+
+// The most blocks a single ARC request can span, which bounds the size of
+// its page
+const MaxARCBlocks = 1 << 20
+
+type arcReader struct {
+	*lineReader
+	blockSize int64
+}
+
+// Reads ARC style block traces, where each line is a request for a range of
+// blocks: "start count [ignored] [request number]". Each request becomes a
+// page with one request per block, all blocks having blockSize as their size
+// and 0 as their backend. Requests for no blocks, for more than MaxARCBlocks
+// or for blocks past the last uint64 are errors.
+func NewARCReader(r io.Reader, blockSize int64) Reader {
+	return &arcReader{newLineReader(r), blockSize}
+}
+
+func (r *arcReader) Next() (*Page, error) {
+	line, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, r.errorf("invalid request %q, expected start and count", line)
+	}
+	start, err1 := strconv.ParseUint(fields[0], 10, 64)
+	count, err2 := strconv.ParseUint(fields[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, r.errorf("invalid request %q, expected start and count", line)
+	}
+	if count == 0 || count > MaxARCBlocks {
+		return nil, r.errorf("invalid request %q, count must be between 1 and %d", line, MaxARCBlocks)
+	}
+	if start > math.MaxUint64-(count-1) {
+		return nil, r.errorf("invalid request %q, blocks past %d", line, uint64(math.MaxUint64))
+	}
+	page := &Page{
+		Requests: make([]*ccache.Request, 0, count),
+		Sizes:    make([]int64, 0, count),
+	}
+	for i := uint64(0); i < count; i++ {
+		page.add(0, start+i, r.blockSize)
+	}
+	return page, nil
+}
+
+type lirsReader struct {
+	*lineReader
+	blockSize int64
+}
+
+// Reads LIRS style block traces, one block number per line. Each block becomes
+// a single request page, with blockSize as its size and 0 as its backend.
+func NewLIRSReader(r io.Reader, blockSize int64) Reader {
+	return &lirsReader{newLineReader(r), blockSize}
+}
+
+func (r *lirsReader) Next() (*Page, error) {
+	line, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	block, err := strconv.ParseUint(line, 10, 64)
+	if err != nil {
+		return nil, r.errorf("invalid block %q", line)
+	}
+	page := &Page{}
+	page.add(0, block, r.blockSize)
+	return page, nil
+}
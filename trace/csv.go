@@ -0,0 +1,69 @@
+package trace
+
+import (
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type csvReader struct {
+	reader *csv.Reader
+	line   int
+}
+
+// Reads timestamp,key,size CSV traces, one single request page per row. The
+// timestamp is either unix seconds or RFC 3339. A backend:uri key is used as
+// is, a numeric key is the uri of backend 0 and any other key is hashed into
+// the uri of backend 0. A header row is skipped.
+func NewCSVReader(r io.Reader) Reader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+	return &csvReader{reader: reader}
+}
+
+func (r *csvReader) Next() (*Page, error) {
+	for {
+		record, err := r.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		r.line++
+
+		size, err := strconv.ParseInt(record[2], 10, 64)
+		if err != nil {
+			if r.line == 1 {
+				// header
+				continue
+			}
+			return nil, fmt.Errorf("row %d: invalid size %q", r.line, record[2])
+		}
+		page := &Page{}
+		if page.Time, err = parseTime(record[0]); err != nil {
+			return nil, fmt.Errorf("row %d: invalid timestamp %q", r.line, record[0])
+		}
+		backend, uri := parseKey(record[1])
+		page.add(backend, uri, size)
+		return page, nil
+	}
+}
+
+func parseKey(key string) (backend, uri uint64) {
+	if i := strings.IndexByte(key, ':'); i != -1 {
+		b, err1 := strconv.ParseUint(key[:i], 10, 64)
+		u, err2 := strconv.ParseUint(key[i+1:], 10, 64)
+		if err1 == nil && err2 == nil {
+			return b, u
+		}
+	}
+	if u, err := strconv.ParseUint(key, 10, 64); err == nil {
+		return 0, u
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return 0, h.Sum64()
+}
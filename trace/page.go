@@ -0,0 +1,64 @@
+package trace
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karlseguin/ccache"
+)
+
+type pageReader struct {
+	*lineReader
+}
+
+// Reads page traces: one page per line, as whitespace separated
+// backend:uri:size entries. A line can start with the page's unix timestamp,
+// in (possibly fractional) seconds:
+//
+//	1543622400.25 1:10:2048 1:11:512 2:7:100
+func NewPageReader(r io.Reader) Reader {
+	return &pageReader{newLineReader(r)}
+}
+
+func (r *pageReader) Next() (*Page, error) {
+	line, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	page := &Page{
+		Requests: make([]*ccache.Request, 0, len(fields)),
+		Sizes:    make([]int64, 0, len(fields)),
+	}
+	if strings.IndexByte(fields[0], ':') == -1 {
+		if page.Time, err = parseTime(fields[0]); err != nil {
+			return nil, r.errorf("invalid timestamp %q", fields[0])
+		}
+		fields = fields[1:]
+	}
+	for _, field := range fields {
+		parts := strings.Split(field, ":")
+		if len(parts) != 3 {
+			return nil, r.errorf("invalid entry %q, expected backend:uri:size", field)
+		}
+		backend, err1 := strconv.ParseUint(parts[0], 10, 64)
+		uri, err2 := strconv.ParseUint(parts[1], 10, 64)
+		size, err3 := strconv.ParseInt(parts[2], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, r.errorf("invalid entry %q, expected backend:uri:size", field)
+		}
+		page.add(backend, uri, size)
+	}
+	return page, nil
+}
+
+// Parses unix timestamps in (possibly fractional) seconds and RFC 3339 times
+func parseTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		sec := int64(seconds)
+		return time.Unix(sec, int64((seconds-float64(sec))*1e9)), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
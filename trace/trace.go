@@ -0,0 +1,109 @@
+// Package trace reads cache traces into pages of ccache requests.
+//
+// Readers stream their input: a page is parsed only when Next is called, so
+// traces don't need to fit in memory.
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/karlseguin/ccache"
+)
+
+// A Page is a batch of requests which were made together
+type Page struct {
+	// When the page was requested, zero if the trace has no timestamps
+	Time     time.Time
+	Requests []*ccache.Request
+	// The size of the object of each request
+	Sizes []int64
+}
+
+// The total size of the page's objects
+func (p *Page) Size() int64 {
+	size := int64(0)
+	for _, s := range p.Sizes {
+		size += s
+	}
+	return size
+}
+
+func (p *Page) add(backend, uri uint64, size int64) {
+	p.Requests = append(p.Requests, &ccache.Request{Backend: backend, Uri: uri})
+	p.Sizes = append(p.Sizes, size)
+}
+
+type Reader interface {
+	// Returns the next page, or io.EOF once the trace is exhausted
+	Next() (*Page, error)
+}
+
+// The formats understood by New
+var Formats = []string{"page", "arc", "lirs", "csv"}
+
+// Creates a reader for the named format. blockSize is the size given to every
+// request of the block formats (arc, lirs), it is ignored by the others.
+func New(format string, r io.Reader, blockSize int64) (Reader, error) {
+	switch strings.ToLower(format) {
+	case "page":
+		return NewPageReader(r), nil
+	case "arc":
+		return NewARCReader(r, blockSize), nil
+	case "lirs":
+		return NewLIRSReader(r, blockSize), nil
+	case "csv":
+		return NewCSVReader(r), nil
+	}
+	return nil, fmt.Errorf("unknown trace format %q", format)
+}
+
+// Calls fn for every page of the trace, stopping at the first error
+func ForEach(r Reader, fn func(page *Page) error) error {
+	for {
+		page, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads a trace line by line, skipping empty lines and # comments
+type lineReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &lineReader{scanner: scanner}
+}
+
+func (r *lineReader) next() (string, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		return line, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
+
+func (r *lineReader) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", r.line, fmt.Sprintf(format, args...))
+}
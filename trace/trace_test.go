@@ -0,0 +1,125 @@
+package trace
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type TraceTests struct{}
+
+func Test_Trace(t *testing.T) {
+	Expectify(new(TraceTests), t)
+}
+
+func (_ TraceTests) ReadsPages() {
+	r := NewPageReader(strings.NewReader("# comment\n1:10:2048 1:11:512\n\n1543622400.5 2:7:100\n"))
+	page, err := r.Next()
+	Expect(err).To.Equal(nil)
+	assertPage(page, []uint64{1, 10, 2048, 1, 11, 512})
+	Expect(page.Time.IsZero()).To.Equal(true)
+	Expect(page.Size()).To.Equal(int64(2560))
+
+	page, err = r.Next()
+	Expect(err).To.Equal(nil)
+	assertPage(page, []uint64{2, 7, 100})
+	Expect(page.Time).To.Equal(time.Unix(1543622400, 500000000))
+
+	_, err = r.Next()
+	Expect(err).To.Equal(io.EOF)
+}
+
+func (_ TraceTests) ReportsTheLineOfInvalidPages() {
+	r := NewPageReader(strings.NewReader("1:2:3\n1:2\n"))
+	r.Next()
+	_, err := r.Next()
+	Expect(err.Error()).To.Equal(`line 2: invalid entry "1:2", expected backend:uri:size`)
+}
+
+func (_ TraceTests) ReadsARCTraces() {
+	r := NewARCReader(strings.NewReader("10 3 0 1\n7 1 0 2\n"), 512)
+	page, _ := r.Next()
+	assertPage(page, []uint64{0, 10, 512, 0, 11, 512, 0, 12, 512})
+	page, _ = r.Next()
+	assertPage(page, []uint64{0, 7, 512})
+	_, err := r.Next()
+	Expect(err).To.Equal(io.EOF)
+}
+
+func (_ TraceTests) RejectsInvalidARCCounts() {
+	for line, message := range map[string]string{
+		"10 0":                   `line 1: invalid request "10 0", count must be between 1 and 1048576`,
+		"10 1048577":             `line 1: invalid request "10 1048577", count must be between 1 and 1048576`,
+		"18446744073709551615 2": `line 1: invalid request "18446744073709551615 2", blocks past 18446744073709551615`,
+	} {
+		_, err := NewARCReader(strings.NewReader(line), 512).Next()
+		Expect(err.Error()).To.Equal(message)
+	}
+	page, err := NewARCReader(strings.NewReader("18446744073709551615 1"), 512).Next()
+	Expect(err).To.Equal(nil)
+	assertPage(page, []uint64{0, 1<<64 - 1, 512})
+}
+
+func (_ TraceTests) ReadsLIRSTraces() {
+	r := NewLIRSReader(strings.NewReader("4\n9\n"), 4096)
+	page, _ := r.Next()
+	assertPage(page, []uint64{0, 4, 4096})
+	page, _ = r.Next()
+	assertPage(page, []uint64{0, 9, 4096})
+	_, err := r.Next()
+	Expect(err).To.Equal(io.EOF)
+}
+
+func (_ TraceTests) ReadsCSVTraces() {
+	r := NewCSVReader(strings.NewReader("timestamp,key,size\n100,3:4,20\n2018-11-19T10:00:00Z, 42, 30\n101,users/4,40\n"))
+	page, err := r.Next()
+	Expect(err).To.Equal(nil)
+	assertPage(page, []uint64{3, 4, 20})
+	Expect(page.Time).To.Equal(time.Unix(100, 0))
+
+	page, _ = r.Next()
+	assertPage(page, []uint64{0, 42, 30})
+	Expect(page.Time.Equal(time.Date(2018, 11, 19, 10, 0, 0, 0, time.UTC))).To.Equal(true)
+
+	page, _ = r.Next()
+	Expect(page.Requests[0].Backend).To.Equal(uint64(0))
+	Expect(page.Requests[0].Uri).Not.To.Equal(uint64(0))
+	Expect(page.Sizes[0]).To.Equal(int64(40))
+
+	_, err = r.Next()
+	Expect(err).To.Equal(io.EOF)
+}
+
+func (_ TraceTests) CreatesReadersByName() {
+	for _, format := range Formats {
+		r, err := New(format, strings.NewReader(""), 512)
+		Expect(err).To.Equal(nil)
+		_, err = r.Next()
+		Expect(err).To.Equal(io.EOF)
+	}
+	_, err := New("nope", strings.NewReader(""), 512)
+	Expect(err).Not.To.Equal(nil)
+}
+
+func (_ TraceTests) IteratesOverEveryPage() {
+	pages := 0
+	err := ForEach(NewLIRSReader(strings.NewReader("1\n2\n3\n"), 1), func(page *Page) error {
+		pages++
+		return nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(pages).To.Equal(3)
+}
+
+// expected holds backend, uri, size triplets
+func assertPage(page *Page, expected []uint64) {
+	Expect(len(page.Requests)).To.Equal(len(expected) / 3)
+	for i, req := range page.Requests {
+		Expect(req.Backend).To.Equal(expected[i*3])
+		Expect(req.Uri).To.Equal(expected[i*3+1])
+		Expect(page.Sizes[i]).To.Equal(int64(expected[i*3+2]))
+	}
+}
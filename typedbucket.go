@@ -0,0 +1,179 @@
+//go:build go1.18
+
+package ccache
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// typedBucket is the TypedCache counterpart of bucket. Items are looked up by
+// their typed key, which is kept in keys, at the same index as the item in arr.
+type typedBucket[K comparable] struct {
+	stats counters
+	sync.RWMutex
+	lookup      map[K]int
+	arr         []*Item
+	keys        []K
+	init        int
+	updateRatio float64
+	aging       *aging
+	memory      bool
+	tracking    bool
+}
+
+func newTypedBucket[K comparable](initSize int, ur float64) *typedBucket[K] {
+	return &typedBucket[K]{
+		lookup:      make(map[K]int),
+		arr:         NewArr(initSize),
+		keys:        make([]K, 0, initSize),
+		init:        initSize,
+		updateRatio: ur,
+	}
+}
+
+func (b *typedBucket[K]) get(key K) *Item {
+	b.RLock()
+	defer b.RUnlock()
+	itemId, ok := b.lookup[key]
+	if ok {
+		item := b.arr[itemId]
+		item.access()
+		return item
+	}
+	return nil
+}
+
+// Like get, but doesn't count as an access
+func (b *typedBucket[K]) peek(key K) *Item {
+	b.RLock()
+	defer b.RUnlock()
+	if itemId, ok := b.lookup[key]; ok {
+		return b.arr[itemId]
+	}
+	return nil
+}
+
+// Sets the item, returning the item it replaced. Like bucket.setItem, a
+// tracked item is left in place, and returned with false.
+func (b *typedBucket[K]) set(key K, value interface{}, r *ReqInfo, duration time.Duration) (*Item, *Item, bool) {
+	expires := time.Now().Add(duration).UnixNano()
+	item := newItem("", value, r, expires)
+	item.typedKey = key
+	item.aging = b.aging
+	if b.memory {
+		item.size = typedEntryMemory(key, int64(unsafe.Sizeof(key)), value)
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if existingId, ok := b.lookup[key]; ok {
+		existing := b.arr[existingId]
+		if b.tracking && existing.pinned() {
+			return item, existing, false
+		}
+		b.arr[existingId] = item
+		item.idx = existingId
+		item.MixReqInfo(&existing.reqInfo, b.updateRatio)
+		return item, existing, true
+	}
+	b.arr = append(b.arr, item)
+	b.keys = append(b.keys, key)
+	item.idx = len(b.arr) - 1
+	b.lookup[key] = item.idx
+	return item, nil, true
+}
+
+func (b *typedBucket[K]) delete(key K) *Item {
+	b.Lock()
+	defer b.Unlock()
+	itemId, ok := b.lookup[key]
+	if !ok {
+		return nil
+	}
+	return b.deleteAt(itemId)
+}
+
+// Removes the item only if it is still stored in the bucket
+func (b *typedBucket[K]) deleteItem(item *Item) bool {
+	b.Lock()
+	defer b.Unlock()
+	if item.idx >= len(b.arr) || b.arr[item.idx] != item {
+		return false
+	}
+	b.deleteAt(item.idx)
+	return true
+}
+
+func (b *typedBucket[K]) deleteAt(itemId int) *Item {
+	item, key := b.arr[itemId], b.keys[itemId]
+	last := len(b.arr) - 1
+	if itemId != last {
+		b.arr[itemId], b.keys[itemId] = b.arr[last], b.keys[last]
+		b.arr[itemId].idx = itemId
+		b.lookup[b.keys[itemId]] = itemId
+	}
+	var zero K
+	b.arr[last], b.keys[last] = nil, zero
+	b.arr, b.keys = b.arr[:last], b.keys[:last]
+	delete(b.lookup, key)
+	return item
+}
+
+// Whether the item is still stored in the bucket
+func (b *typedBucket[K]) contains(item *Item) bool {
+	b.RLock()
+	defer b.RUnlock()
+	return item.idx < len(b.arr) && b.arr[item.idx] == item
+}
+
+func (b *typedBucket[K]) getNum() int {
+	b.RLock()
+	defer b.RUnlock()
+	return len(b.arr)
+}
+
+// Like bucket.expired, the items among count items starting at from which
+// expired before now, and how many items were looked at
+func (b *typedBucket[K]) expired(from, count int, now int64) ([]*Item, int) {
+	b.RLock()
+	defer b.RUnlock()
+	if from >= len(b.arr) {
+		return nil, 0
+	}
+	if rest := len(b.arr) - from; count > rest {
+		count = rest
+	}
+	var expired []*Item
+	for _, item := range b.arr[from : from+count] {
+		if atomic.LoadInt64(&item.expires) < now {
+			expired = append(expired, item)
+		}
+	}
+	return expired, count
+}
+
+func (b *typedBucket[K]) getCandidate(e Evaluator) (*Item, float64) {
+	b.RLock()
+	defer b.RUnlock()
+	l := len(b.arr)
+	if l == 0 {
+		return nil, 0
+	}
+	item := b.arr[rand.Intn(l)]
+	return item, e.Eval(item)
+}
+
+// Removes every item and returns them
+func (b *typedBucket[K]) clear() []*Item {
+	b.Lock()
+	defer b.Unlock()
+	items := b.arr
+	b.lookup = make(map[K]int)
+	b.arr = NewArr(b.init)
+	b.keys = make([]K, 0, b.init)
+	return items
+}
@@ -0,0 +1,371 @@
+//go:build go1.18
+
+package ccache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Hasher maps a key to the hash used to pick its bucket. Keys which are equal
+// must hash to the same value.
+type Hasher[K comparable] func(key K) uint32
+
+// TypedCache is a Cache whose keys are K and whose values are V. Keys are
+// used as they are, without being formatted into strings, and are spread over
+// the buckets by the given Hasher. Eviction, tracking, the sweeper and Fetch
+// work exactly like Cache's. Items keep their key, see Item.TypedKey.
+type TypedCache[K comparable, V any] struct {
+	*Configuration
+	evictor
+	size       int64
+	hash       Hasher[K]
+	buckets    []*typedBucket[K]
+	bucketMask uint32
+	eval       Evaluator
+	observer   Observer
+	flights    typedFlights[K]
+	sweeper    sweeper
+	// guards the sweeper's channels, which Stop and restart replace
+	runLock sync.Mutex
+	stop    chan struct{}
+	donec   chan struct{}
+}
+
+// A cached value along with its metadata. Value() returns V rather than an
+// interface{}.
+type TypedItem[V any] struct {
+	*Item
+}
+
+func (i TypedItem[V]) Value() V {
+	v, _ := i.Item.value.(V)
+	return v
+}
+
+// Create a new typed cache with the specified configuration and key hasher
+// See ccache.Configure() for creating a configuration. Panics if the
+// configuration enables CoalescePages, since a TypedCache has no pages.
+func NewTyped[K comparable, V any](config *Configuration, hash Hasher[K]) *TypedCache[K, V] {
+	if config.coalescePages > 0 {
+		panic("ccache: CoalescePages doesn't apply to a TypedCache, which has no pages")
+	}
+	c := &TypedCache[K, V]{
+		Configuration: config,
+		evictor:       newEvictor(config),
+		hash:          hash,
+		bucketMask:    uint32(config.buckets) - 1,
+		buckets:       make([]*typedBucket[K], config.buckets),
+		eval:          config.newEvaluator(),
+	}
+	c.observer, _ = c.eval.(Observer)
+	c.rounds, _ = c.eval.(roundObserver)
+	for i := 0; i < int(config.buckets); i++ {
+		c.buckets[i] = newTypedBucket[K](config.initBucketSize, c.updateRatio)
+		c.buckets[i].aging = c.aging
+		c.buckets[i].memory = c.memory
+		c.buckets[i].tracking = c.tracking
+	}
+	c.restart()
+	return c
+}
+
+// Get an item from the cache. The second return value is false if the item
+// wasn't found. Like Cache.Get, this can return an expired item.
+func (c *TypedCache[K, V]) Get(key K) (TypedItem[V], bool) {
+	bucket := c.bucket(key)
+	item := bucket.get(key)
+	if item == nil {
+		bucket.stats.miss()
+		return TypedItem[V]{}, false
+	}
+	bucket.stats.hit(item)
+	if c.observer != nil {
+		c.observer.OnGet(item)
+	}
+	return TypedItem[V]{item}, true
+}
+
+// Used when the cache was created with the Track() configuration option.
+// Avoid otherwise
+func (c *TypedCache[K, V]) TrackingGet(key K) TrackedItem {
+	item, ok := c.Get(key)
+	if !ok {
+		return NilTracked
+	}
+	item.track()
+	return item.Item
+}
+
+// Set the value in the cache for the specified duration
+func (c *TypedCache[K, V]) Set(key K, value V, duration time.Duration) {
+	atomic.AddUint64(&c.counter, 1)
+	c.set(key, value, getDefaultReqInfo(value), duration)
+}
+
+// Set the value in the cache for the specified duration, with the request
+// information used by the h1 and h2 evaluators
+func (c *TypedCache[K, V]) SetWithInfo(key K, value V, r *ReqInfo, duration time.Duration) {
+	atomic.AddUint64(&c.counter, 1)
+	c.set(key, value, r, duration)
+}
+
+// Replace the value if it exists, does not set if it doesn't.
+// Returns true if the item existed an was replaced, false otherwise, which
+// includes a tracked item left in place.
+// Replace does not reset item's TTL
+func (c *TypedCache[K, V]) Replace(key K, value V) bool {
+	item := c.bucket(key).peek(key)
+	if item == nil {
+		return false
+	}
+	atomic.AddUint64(&c.counter, 1)
+	_, replaced := c.set(key, value, getDefaultReqInfo(value), item.TTL())
+	return replaced
+}
+
+// Attempts to get the value from the cache and calls fetch on a miss (missing
+// or stale item). If fetch returns an error, no value is cached and the error
+// is returned back to the caller. Like Cache.Fetch, concurrent misses on the
+// same key are coalesced: fetch only runs in one of the callers and the
+// others get its result, or its error.
+func (c *TypedCache[K, V]) Fetch(key K, duration time.Duration, fetch func() (V, error)) (TypedItem[V], error) {
+	if item, ok := c.Get(key); ok && !item.Expired() {
+		return item, nil
+	}
+	fl, leader := c.flights.claim(key)
+	if leader {
+		item, err := c.fetchFlight(key, duration, fetch)
+		return TypedItem[V]{item}, err
+	}
+	<-fl.done
+	if fl.err != nil || fl.item != nil {
+		return TypedItem[V]{fl.item}, fl.err
+	}
+	// fetch panicked in the other caller, try it ourselves
+	item, err := c.load(key, duration, fetch)
+	return TypedItem[V]{item}, err
+}
+
+// Loads the value and completes the key's flight with the result, even if
+// fetch panics
+func (c *TypedCache[K, V]) fetchFlight(key K, duration time.Duration, fetch func() (V, error)) (item *Item, err error) {
+	defer func() {
+		c.flights.complete(key, item, err)
+	}()
+	// the previous flight could have landed between our Get and our claim
+	if existing := c.bucket(key).peek(key); existing != nil && !existing.Expired() {
+		return existing, nil
+	}
+	return c.load(key, duration, fetch)
+}
+
+func (c *TypedCache[K, V]) load(key K, duration time.Duration, fetch func() (V, error)) (*Item, error) {
+	value, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&c.counter, 1)
+	item, _ := c.set(key, value, getDefaultReqInfo(value), duration)
+	return item, nil
+}
+
+// Remove the item from the cache, return true if the item was present, false otherwise.
+func (c *TypedCache[K, V]) Delete(key K) bool {
+	atomic.AddUint64(&c.counter, 1)
+	bucket := c.bucket(key)
+	item := bucket.delete(key)
+	if item == nil {
+		return false
+	}
+	bucket.stats.delete()
+	c.afterDelete(item, RemovedDeleted, 0)
+	return true
+}
+
+// Removes every item. Isn't thread safe, it's meant to be called from non-concurrent tests
+func (c *TypedCache[K, V]) Clear() {
+	for _, bucket := range c.buckets {
+		for _, item := range bucket.clear() {
+			c.evicted(item, RemovedCleared, 0)
+		}
+	}
+	atomic.StoreInt64(&c.size, 0)
+}
+
+// Changes the max size (the max memory, with MaxMemory) of the cache. If the
+// cache holds more than that, it's shrunk in the background, a few items at
+// a time. Candidates, ItemsToPrune and CountPerSampling can be changed
+// likewise with SetCandidates, SetItemsToPrune and SetCountPerSampling.
+func (c *TypedCache[K, V]) SetMaxSize(max int64) {
+	c.resize(max, &c.size, c)
+}
+
+// Stops the background sweeper and waits for it to exit. The cache remains
+// usable, but expired items are no longer removed proactively
+func (c *TypedCache[K, V]) Stop() {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	if c.donec == nil {
+		return
+	}
+	close(c.stop)
+	<-c.donec
+	c.donec = nil
+}
+
+func (c *TypedCache[K, V]) restart() {
+	if c.sweepInterval == 0 {
+		return
+	}
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	if c.donec != nil {
+		// already running
+		return
+	}
+	c.stop = make(chan struct{})
+	c.donec = make(chan struct{})
+	go c.sweep(c.stop, c.donec)
+}
+
+func (c *TypedCache[K, V]) sweep(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(c.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sweepPass(c.sweepBudget)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Like Cache.sweepPass, walks up to budget items and removes the expired ones.
+// Returns the number of items removed.
+func (c *TypedCache[K, V]) sweepPass(budget int) int {
+	now := time.Now().UnixNano()
+	removed := 0
+	s := &c.sweeper
+	for visited := 0; budget > 0 && visited <= len(c.buckets); {
+		bucket := c.buckets[s.bucket]
+		expired, looked := bucket.expired(s.position, budget, now)
+		budget -= looked
+		deleted := 0
+		for _, item := range expired {
+			if bucket.deleteItem(item) {
+				c.afterDelete(item, RemovedExpired, 0)
+				bucket.stats.evict(item, EvictedExpired)
+				if c.observer != nil {
+					c.observer.OnEvict(item)
+				}
+				deleted++
+			}
+		}
+		// removals move the bucket's last item in the freed slot, don't skip it
+		s.position += looked - deleted
+		removed += deleted
+		if looked == 0 {
+			s.bucket = (s.bucket + 1) & int(c.bucketMask)
+			s.position = 0
+			visited++
+		}
+	}
+	return removed
+}
+
+// Returns a snapshot of the cache's statistics
+func (c *TypedCache[K, V]) Stats() Stats {
+	s := newStats(nil, len(c.buckets))
+	for i, bucket := range c.buckets {
+		s.addBucket(i, &bucket.stats)
+	}
+	return s
+}
+
+// Sets the item, and returns it along with whether it was cached, which it
+// isn't when it would replace a tracked item
+func (c *TypedCache[K, V]) set(key K, value V, r *ReqInfo, duration time.Duration) (*Item, bool) {
+	bucket := c.bucket(key)
+	item, existing, stored := bucket.set(key, value, r, duration)
+	if !stored {
+		bucket.stats.keep()
+		return item, false
+	}
+	bucket.stats.set(item)
+	if existing != nil {
+		c.afterDelete(existing, RemovedReplaced, 0)
+	}
+	atomic.AddInt64(&c.size, item.size)
+	if c.observer != nil {
+		c.observer.OnSet(item)
+	}
+	c.evictor.evict(&c.size, c)
+	return item, true
+}
+
+func (c *TypedCache[K, V]) bucket(key K) *typedBucket[K] {
+	return c.buckets[c.hash(key)&c.bucketMask]
+}
+
+// score is the evaluator's score of an item it picked for eviction, 0 for
+// every other removal
+func (c *TypedCache[K, V]) afterDelete(item *Item, reason RemovalReason, score float64) {
+	atomic.AddInt64(&c.size, -item.size)
+	c.evicted(item, reason, score)
+	if c.onDelete != nil {
+		// a tracked item is only cleaned up once it has been released
+		if c.tracking && item.orphan(c.onDelete) {
+			return
+		}
+		c.onDelete(item)
+	}
+}
+
+// Calls OnEvict
+func (c *TypedCache[K, V]) evicted(item *Item, reason RemovalReason, score float64) {
+	if c.onEvict != nil {
+		c.onEvict(item, reason, score)
+	}
+}
+
+func (c *TypedCache[K, V]) buildSamplingTables() *samplingTables {
+	nums := make([]int, len(c.buckets))
+	for i, bucket := range c.buckets {
+		nums[i] = bucket.getNum()
+	}
+	return buildSamplingTables(nums)
+}
+
+func (c *TypedCache[K, V]) evictionCandidate(bucket int) (*Item, float64) {
+	item, val := c.buckets[bucket].getCandidate(c.eval)
+	if item != nil && c.tracking && item.pinned() {
+		return nil, 0
+	}
+	return item, val
+}
+
+func (c *TypedCache[K, V]) rescore(bucket int, item *Item) (float64, bool) {
+	if !c.buckets[bucket].contains(item) || (c.tracking && item.pinned()) {
+		return 0, false
+	}
+	return c.eval.Eval(item), true
+}
+
+func (c *TypedCache[K, V]) evictItem(bucket int, item *Item, score float64) {
+	reason := EvictedForSpace
+	if item.Expired() {
+		reason = EvictedExpired
+	}
+	if c.buckets[bucket].deleteItem(item) == false {
+		return
+	}
+	c.afterDelete(item, reason.removal(), score)
+	c.buckets[bucket].stats.evict(item, reason)
+	if c.observer != nil {
+		c.observer.OnEvict(item)
+	}
+}
@@ -0,0 +1,273 @@
+//go:build go1.18
+
+package ccache
+
+import (
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type TypedCacheTests struct{}
+
+func Test_TypedCache(t *testing.T) {
+	Expectify(new(TypedCacheTests), t)
+}
+
+type pageKey struct {
+	Backend uint64
+	Uri     uint64
+}
+
+func hashPageKey(k pageKey) uint32 {
+	return HashUint64(k.Backend)*31 + HashUint64(k.Uri)
+}
+
+func (_ TypedCacheTests) GetsAndSetsTypedValues() {
+	cache := NewTyped[pageKey, *SizedItem](Configure(), hashPageKey)
+	cache.Set(pageKey{1, 2}, &SizedItem{12, 3}, time.Minute)
+	item, ok := cache.Get(pageKey{1, 2})
+	Expect(ok).To.Equal(true)
+	Expect(item.Value().id).To.Equal(12)
+	Expect(item.Size()).To.Equal(int64(3))
+	_, ok = cache.Get(pageKey{2, 1})
+	Expect(ok).To.Equal(false)
+}
+
+func (_ TypedCacheTests) DeletesAValue() {
+	cache := NewTyped[string, string](Configure(), HashString)
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	Expect(cache.Delete("spice")).To.Equal(true)
+	Expect(cache.Delete("spice")).To.Equal(false)
+	_, ok := cache.Get("spice")
+	Expect(ok).To.Equal(false)
+	item, _ := cache.Get("worm")
+	Expect(item.Value()).To.Equal("sand")
+}
+
+func (_ TypedCacheTests) ReplacesExistingValuesOnly() {
+	cache := NewTyped[uint64, int](Configure(), HashUint64)
+	Expect(cache.Replace(4, 5)).To.Equal(false)
+	cache.Set(4, 4, time.Minute)
+	Expect(cache.Replace(4, 5)).To.Equal(true)
+	item, _ := cache.Get(4)
+	Expect(item.Value()).To.Equal(5)
+}
+
+func (_ TypedCacheTests) FetchesMissingAndExpiredItems() {
+	cache := NewTyped[uint64, string](Configure(), HashUint64)
+	cache.Set(1, "moo", -time.Second)
+	item, _ := cache.Fetch(1, time.Minute, func() (string, error) { return "moo-moo", nil })
+	Expect(item.Value()).To.Equal("moo-moo")
+	_, err := cache.Fetch(2, time.Minute, func() (string, error) { return "", errors.New("no cow") })
+	Expect(err.Error()).To.Equal("no cow")
+	_, ok := cache.Get(2)
+	Expect(ok).To.Equal(false)
+}
+
+func (_ TypedCacheTests) CoalescesFetches() {
+	cache := NewTyped[uint64, string](Configure(), HashUint64)
+	loads := int32(0)
+	fetch := func() (string, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(time.Millisecond * 20)
+		return "flow", nil
+	}
+	items := fetchConcurrently(10, func() (*Item, error) {
+		item, err := cache.Fetch(1, time.Minute, fetch)
+		return item.Item, err
+	})
+	Expect(loads).To.Equal(int32(1))
+	for _, item := range items {
+		Expect(item.Value()).To.Equal("flow")
+	}
+}
+
+func (_ TypedCacheTests) AdaptiveRemembersTypedKeys() {
+	a, _ := NewAdaptive(10, "lru")
+	cache := NewTyped[uint64, int](Configure().Evaluator(a).MaxSize(1).ItemsToPrune(1), HashUint64)
+	cache.Set(1, 1, time.Minute)
+	cache.Set(2, 2, time.Minute)
+	Expect(a.ghosts[0].keys).To.Equal(map[interface{}]uint64{uint64(1): 1})
+	// setting 1 again finds it in the ghost history, and evicts 2
+	cache.Set(1, 1, time.Minute)
+	Expect(a.ghosts[0].keys).To.Equal(map[interface{}]uint64{uint64(2): 2})
+}
+
+func (_ TypedCacheTests) KeepsTheKeysOfItems() {
+	var deleted []interface{}
+	cache := NewTyped[pageKey, string](Configure().OnDelete(func(item *Item) {
+		deleted = append(deleted, item.TypedKey())
+	}), hashPageKey)
+	cache.Set(pageKey{1, 2}, "flow", time.Minute)
+	item, _ := cache.Get(pageKey{1, 2})
+	Expect(item.TypedKey()).To.Equal(pageKey{1, 2})
+	Expect(item.Key()).To.Equal("{1 2}")
+	cache.Delete(pageKey{1, 2})
+	Expect(deleted).To.Equal([]interface{}{pageKey{1, 2}})
+}
+
+func (_ TypedCacheTests) DoesntEvictTrackedItems() {
+	cache := NewTyped[uint64, int](Configure().MaxSize(5).ItemsToPrune(1).Track(), HashUint64)
+	cache.Set(0, 0, time.Minute)
+	item := cache.TrackingGet(0)
+	for i := uint64(1); i < 100; i++ {
+		cache.Set(i, int(i), time.Minute)
+	}
+	_, ok := cache.Get(0)
+	Expect(ok).To.Equal(true)
+	Expect(cache.size).To.Equal(int64(5))
+	item.Release()
+	Expect(cache.TrackingGet(1000)).To.Equal(TrackedItem(NilTracked))
+}
+
+func (_ TypedCacheTests) SetsLeaveTrackedItemsInPlace() {
+	cache := NewTyped[uint64, string](Configure().Track(), HashUint64)
+	cache.Set(1, "flow", time.Minute)
+	item := cache.TrackingGet(1)
+	cache.Set(1, "must", time.Minute)
+	Expect(cache.Replace(1, "gold")).To.Equal(false)
+	got, _ := cache.Get(1)
+	Expect(got.Value()).To.Equal("flow")
+	Expect(cache.Stats().NotReplaced).To.Equal(uint64(2))
+
+	item.Release()
+	Expect(cache.Replace(1, "must")).To.Equal(true)
+	got, _ = cache.Get(1)
+	Expect(got.Value()).To.Equal("must")
+}
+
+func (_ TypedCacheTests) SweepsExpiredItems() {
+	cache := NewTyped[uint64, int](Configure().Buckets(1).SweepInterval(time.Millisecond*5), HashUint64)
+	for i := uint64(0); i < 10; i++ {
+		cache.Set(i, int(i), time.Millisecond*10)
+	}
+	cache.Set(10, 10, time.Minute)
+	time.Sleep(time.Millisecond * 50)
+	cache.Stop()
+	Expect(cache.size).To.Equal(int64(1))
+	cache.Stop()
+
+	cache.Set(11, 11, -time.Minute)
+	Expect(cache.sweepPass(10)).To.Equal(1)
+}
+
+func (_ TypedCacheTests) RejectsCoalescePages() {
+	defer func() {
+		Expect(recover()).To.Equal("ccache: CoalescePages doesn't apply to a TypedCache, which has no pages")
+	}()
+	NewTyped[uint64, int](Configure().CoalescePages(time.Second), HashUint64)
+}
+
+func (_ TypedCacheTests) EvictsToStayUnderMaxSize() {
+	deleted := 0
+	cache := NewTyped[uint64, int](Configure().MaxSize(50).Buckets(4).Candidates(4).OnDelete(func(item *Item) {
+		deleted++
+	}), HashUint64)
+	for i := uint64(0); i < 200; i++ {
+		cache.Set(i, int(i), time.Minute)
+	}
+	Expect(cache.size <= 50).To.Equal(true)
+	Expect(deleted).To.Equal(int(200 - cache.size))
+	stats := cache.Stats()
+	Expect(stats.Sets).To.Equal(uint64(200))
+	Expect(stats.TotalEvictions()).To.Equal(uint64(deleted))
+
+	count := 0
+	for i := uint64(0); i < 200; i++ {
+		if item, ok := cache.Get(i); ok {
+			Expect(item.Value()).To.Equal(int(i))
+			count++
+		}
+	}
+	Expect(int64(count)).To.Equal(cache.size)
+}
+
+func (_ TypedCacheTests) OnEvictReportsEveryRemoval() {
+	removed := recordRemovals()
+	cache := NewTyped[string, string](removed.configure(Configure().MaxSize(3).ItemsToPrune(1).Buckets(1).Candidates(1)), HashString)
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("spice", "must", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	cache.Delete("worm")
+	Expect(removed.reasons).To.Equal(map[interface{}]RemovalReason{"flow": RemovedReplaced, "sand": RemovedDeleted})
+
+	cache.Set("leto", "ghanima", -time.Minute)
+	cache.Set("paul", "alia", time.Minute)
+	cache.Set("duncan", "idaho", time.Minute)
+	Expect(len(removed.reasons)).To.Equal(3)
+	for value, reason := range removed.reasons {
+		if value == "ghanima" {
+			Expect(reason).To.Equal(RemovedExpired)
+		} else if reason != RemovedReplaced && reason != RemovedDeleted {
+			Expect(reason).To.Equal(RemovedEvicted)
+			Expect(removed.scores[value]).To.Equal(1.0)
+		}
+	}
+	cache.Clear()
+	Expect(len(removed.reasons)).To.Equal(6)
+}
+
+func (_ TypedCacheTests) AgesFrequencies() {
+	cache := NewTyped[string, string](Configure().FrequencyHalfLife(time.Hour), HashString)
+	cache.Set("spice", "flow", time.Minute)
+	item, _ := cache.Get("spice")
+	Expect(item.aging).To.Equal(cache.aging)
+	Expect(item.Frequency()).To.Equal(int64(1))
+}
+
+func (_ TypedCacheTests) CountsEntriesForTheirMemory() {
+	cache := NewTyped[string, string](Configure().MaxMemory(1<<20), HashString)
+	item, _ := cache.set("spice", "flow", getDefaultReqInfo("flow"), time.Minute)
+	Expect(item.Size()).To.Equal(typedEntryMemory("spice", 16, "flow"))
+	Expect(item.Size() > entryMemory("spice", "flow")).To.Equal(true)
+}
+
+func (_ TypedCacheTests) ShrinksWhenResized() {
+	cache := NewTyped[uint64, int](Configure().MaxSize(100).ItemsToPrune(10), HashUint64)
+	for i := 0; i < 100; i++ {
+		cache.Set(uint64(i), i, time.Minute)
+	}
+	cache.SetMaxSize(30)
+	waitForShrink(&cache.evictor)
+	Expect(cache.size).To.Equal(int64(30))
+}
+
+func (_ TypedCacheTests) HashStringMatchesFNV() {
+	cache := New(Configure())
+	for _, key := range []string{"", "spice", "1:2"} {
+		Expect(cache.table().buckets[HashString(key)&cache.table().mask]).To.Equal(cache.bucket(key))
+	}
+}
+
+func (_ TypedCacheTests) IsSafeForConcurrentUse() {
+	cache := NewTyped[uint64, int](Configure().MaxSize(100).ItemsToPrune(10).EvictionPool(8), HashUint64)
+	stress(func(r *rand.Rand) {
+		key := uint64(r.Intn(200))
+		switch r.Intn(4) {
+		case 0:
+			if item, ok := cache.Get(key); ok {
+				item.Value()
+				item.AccessCount()
+			}
+		case 1:
+			cache.Set(key, int(key), time.Minute)
+		case 2:
+			cache.Delete(key)
+		case 3:
+			cache.Fetch(key, time.Minute, func() (int, error) { return int(key), nil })
+		}
+	})
+	total := int64(0)
+	for _, bucket := range cache.buckets {
+		bucket.RLock()
+		total += int64(len(bucket.arr))
+		bucket.RUnlock()
+	}
+	Expect(atomic.LoadInt64(&cache.size)).To.Equal(total)
+}
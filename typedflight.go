@@ -0,0 +1,40 @@
+//go:build go1.18
+
+package ccache
+
+import "sync"
+
+// The TypedCache counterpart of flights, coalescing concurrent Fetch misses
+// on the same typed key
+type typedFlights[K comparable] struct {
+	sync.Mutex
+	calls map[K]*flight
+}
+
+// Returns the flight for the key, and true if the caller started it and is
+// thus responsible for completing it
+func (f *typedFlights[K]) claim(key K) (*flight, bool) {
+	f.Lock()
+	defer f.Unlock()
+	if fl, ok := f.calls[key]; ok {
+		return fl, false
+	}
+	if f.calls == nil {
+		f.calls = make(map[K]*flight)
+	}
+	fl := &flight{done: make(chan struct{})}
+	f.calls[key] = fl
+	return fl, true
+}
+
+// Completes the key's flight, handing the result to its waiters
+func (f *typedFlights[K]) complete(key K, item *Item, err error) {
+	f.Lock()
+	fl, ok := f.calls[key]
+	delete(f.calls, key)
+	f.Unlock()
+	if ok {
+		fl.item, fl.err = item, err
+		close(fl.done)
+	}
+}
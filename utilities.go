@@ -1,15 +1,105 @@
 package ccache
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
 
-func buildKey (backend, uri uint64) string {
-	return fmt.Sprintf("%v:%v", backend, uri)
+// Page keys are "backend:uri", both in decimal without leading zeros. Any key
+// of that form, whether it was set by SetPage or by Set, is the key of that
+// backend and uri's object, and is bucketed by hashing the two numbers rather
+// than with the KeyHasher. They're built and parsed without fmt.
+
+// The length of the longest page key: two 20 digit numbers and the ':'
+const maxPageKeySize = 41
+
+func buildKey(backend, uri uint64) string {
+	var buf [maxPageKeySize]byte
+	return string(putKey(&buf, backend, uri))
+}
+
+// Encodes the page key of backend and uri into buf
+func putKey(buf *[maxPageKeySize]byte, backend, uri uint64) []byte {
+	key := strconv.AppendUint(buf[:0], backend, 10)
+	key = append(key, ':')
+	return strconv.AppendUint(key, uri, 10)
 }
 
 func parseKey(key string) (backend, uri uint64, err error) {
-	if n,err := fmt.Sscanf(key, "%v:%v", &backend, &uri); n != 2 || err != nil {
-		return 0, 0, err
+	backend, uri, ok := splitKey(key)
+	if !ok {
+		return 0, 0, fmt.Errorf("ccache: %q isn't a page key", key)
 	}
-
 	return backend, uri, nil
-}
\ No newline at end of file
+}
+
+// The backend and uri of a page key, if key is one
+func splitKey(key string) (backend, uri uint64, ok bool) {
+	i := strings.IndexByte(key, ':')
+	if i == -1 {
+		return 0, 0, false
+	}
+	if backend, ok = parseDecimal(key[:i]); !ok {
+		return 0, 0, false
+	}
+	if uri, ok = parseDecimal(key[i+1:]); !ok {
+		return 0, 0, false
+	}
+	return backend, uri, true
+}
+
+// Parses s as strconv.FormatUint formats a uint64, so that a page has a
+// single key
+func parseDecimal(s string) (uint64, bool) {
+	if len(s) == 0 || (s[0] == '0' && len(s) > 1) {
+		return 0, false
+	}
+	n := uint64(0)
+	for i := 0; i < len(s); i++ {
+		d := uint64(s[i] - '0')
+		if d > 9 || n > (math.MaxUint64-d)/10 {
+			return 0, false
+		}
+		n = n*10 + d
+	}
+	return n, true
+}
+
+// The hash which picks the bucket of key. Page keys hash their backend and
+// uri, other keys are hashed with hasher.
+func hashKey(key string, hasher func(key string) uint32) uint32 {
+	if backend, uri, ok := splitKey(key); ok {
+		return hashPage(backend, uri)
+	}
+	return hasher(key)
+}
+
+func hashPage(backend, uri uint64) uint32 {
+	return HashUint64(backend)*31 + HashUint64(uri)
+}
+
+// HashString is the FNV-1a hash Cache and LayeredCache use by default (see
+// KeyHasher), computed without allocating
+func HashString(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// HashUint64 mixes the bits of n, so that sequential integers spread evenly
+// over the buckets. Composite keys can combine the hashes of their fields:
+//
+//	func(k pageKey) uint32 { return HashUint64(k.Backend)*31 + HashUint64(k.Uri) }
+func HashUint64(n uint64) uint32 {
+	n ^= n >> 33
+	n *= 0xff51afd7ed558ccd
+	n ^= n >> 33
+	n *= 0xc4ceb9fe1a85ec53
+	n ^= n >> 33
+	return uint32(n)
+}